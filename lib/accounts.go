@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// RunAccounts runs every account in a separate process, with the same arguments and
+// --account <name>. With a concurrency of 1 the accounts are run sequentially and the
+// output streamed, else the output of each account is printed once it completes.
+// Returns the number of accounts which failed.
+func RunAccounts(args []string, concurrency int) int {
+	exe, err := os.Executable()
+	if err != nil {
+		Log.Error(err.Error())
+		return len(Accounts)
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	failed := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for _, acc := range Accounts {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// #nosec
+			cmd := exec.Command(exe, append(append([]string{}, args...), "--account", name)...)
+			cmd.Stdin = os.Stdin
+
+			var stdout, stderr bytes.Buffer
+			if concurrency == 1 {
+				Log.InfoF("===== %s =====\n", name)
+				cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			} else {
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			}
+
+			err := cmd.Run()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if concurrency > 1 {
+				Log.InfoF("===== %s =====\n", name)
+				_, _ = os.Stderr.Write(stderr.Bytes())
+				_, _ = os.Stdout.Write(stdout.Bytes())
+			}
+
+			if err != nil {
+				Log.ErrorF("Account \"%s\" failed: %s", name, err)
+				failed++
+			} else if concurrency == 1 {
+				Log.Info("")
+			}
+		}(acc.Name)
+	}
+
+	wg.Wait()
+
+	return failed
+}
+
+// AccountFile returns a file name with the account name added when the config contains
+// multiple accounts, eg: results.json => results-work.json
+func AccountFile(file string) string {
+	if len(Accounts) < 2 || Config.Name == "" {
+		return file
+	}
+
+	ext := path.Ext(file)
+
+	return strings.TrimSuffix(file, ext) + "-" + fileNameReplacer.Replace(Config.Name) + ext
+}
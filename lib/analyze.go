@@ -0,0 +1,261 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"gopkg.in/yaml.v3"
+)
+
+// analyzeTop is the number of entries listed per section of the analysis
+const analyzeTop = 10
+
+// usage is the number of messages (or attachments) and total bytes of a group
+type usage struct {
+	Name  string
+	Count int
+	Bytes uint64
+}
+
+// usageMap is a set of usage groups by name
+type usageMap map[string]*usage
+
+// add adds a message (or attachment) to a group
+func (m usageMap) add(name string, size uint64) {
+	if _, ok := m[name]; !ok {
+		m[name] = &usage{Name: name}
+	}
+	m[name].Count++
+	m[name].Bytes += size
+}
+
+// top returns the n largest groups by bytes, or by count
+func (m usageMap) top(n int, byCount bool) []usage {
+	list := []usage{}
+	for _, u := range m {
+		list = append(list, *u)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if byCount && list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	if len(list) > n {
+		list = list[:n]
+	}
+
+	return list
+}
+
+// ageBucket is a message age range of the age histogram
+type ageBucket struct {
+	Name   string
+	Before time.Time // messages older than this (zero for the last bucket)
+}
+
+// analyzedMessage is a message listed in the largest messages
+type analyzedMessage struct {
+	UID     uint32
+	Date    time.Time
+	From    string
+	Subject string
+	Size    uint64
+}
+
+// Analyze scans all messages in a mailbox, and reports the top senders & domains,
+// largest messages, attachment types and an age histogram. If suggest is set,
+// rules are suggested for the largest attachment types & senders.
+func Analyze(c *client.Client, mailbox string, suggest bool) error {
+	mbox, err := c.Select(mailbox, true)
+	if err != nil {
+		return err
+	}
+
+	if mbox.Messages == 0 {
+		Log.InfoF("%s has no messages", mailbox)
+		return nil
+	}
+
+	Log.DebugF("Analyzing %d messages in \"%s\"...", mbox.Messages, mailbox)
+
+	now := time.Now()
+	buckets := []ageBucket{
+		{"< 1 month", now.AddDate(0, -1, 0)},
+		{"1-6 months", now.AddDate(0, -6, 0)},
+		{"6-12 months", now.AddDate(-1, 0, 0)},
+		{"1-2 years", now.AddDate(-2, 0, 0)},
+		{"2-5 years", now.AddDate(-5, 0, 0)},
+		{"> 5 years", time.Time{}},
+	}
+
+	senders := usageMap{}
+	domains := usageMap{}
+	types := usageMap{}
+	ages := usageMap{}
+	oldTypes := usageMap{} // attachment types of messages older than a year
+	largest := []analyzedMessage{}
+	var total uint64
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchInternalDate, imap.FetchBodyStructure}, messages)
+	}()
+
+	for msg := range messages {
+		size := uint64(msg.Size)
+		total += size
+		date := MessageDate(msg)
+
+		sender := "unknown"
+		subject := ""
+		if msg.Envelope != nil {
+			subject = msg.Envelope.Subject
+			if len(msg.Envelope.From) > 0 && msg.Envelope.From[0].Address() != "" {
+				sender = strings.ToLower(msg.Envelope.From[0].Address())
+			}
+		}
+		senders.add(sender, size)
+		if _, domain, ok := strings.Cut(sender, "@"); ok {
+			domains.add(domain, size)
+		}
+
+		for _, b := range buckets {
+			if b.Before.IsZero() || date.After(b.Before) {
+				ages.add(b.Name, size)
+				break
+			}
+		}
+
+		if msg.BodyStructure != nil {
+			msg.BodyStructure.Walk(func(p []int, part *imap.BodyStructure) bool {
+				if len(part.Parts) > 0 {
+					return true
+				}
+				mimeType := strings.ToLower(part.MIMEType + "/" + part.MIMESubType)
+				if isAttachment(mimeType, strings.ToLower(part.Disposition)) {
+					types.add(mimeType, decodedSize(part))
+					if date.Before(now.AddDate(-1, 0, 0)) {
+						oldTypes.add(mimeType, decodedSize(part))
+					}
+				}
+				return true
+			})
+		}
+
+		largest = append(largest, analyzedMessage{msg.Uid, date, sender, subject, size})
+		if len(largest) > analyzeTop*10 {
+			largest = largestMessages(largest)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+
+	Log.InfoF("\n%s: %d messages, %s\n", mailbox, mbox.Messages, ByteCountSI(total))
+
+	printUsage("Top senders by count", "Sender", senders.top(analyzeTop, true))
+	printUsage("Top senders by size", "Sender", senders.top(analyzeTop, false))
+	printUsage("Top domains by count", "Domain", domains.top(analyzeTop, true))
+	printUsage("Top domains by size", "Domain", domains.top(analyzeTop, false))
+
+	Log.Info("Largest messages")
+	for _, m := range largestMessages(largest) {
+		Log.InfoF(" %-8d %s  %-40s %-50s %9s", m.UID, m.Date.Format("02-Jan-06"), Truncate(m.From, 40), Truncate(m.Subject, 50), ByteCountSI(m.Size))
+	}
+	Log.Info("")
+
+	printUsage("Attachments by type", "MIME type", types.top(len(types), false))
+
+	Log.Info("Message age")
+	for _, b := range buckets {
+		u, ok := ages[b.Name]
+		if !ok {
+			u = &usage{Name: b.Name}
+		}
+		Log.InfoF(" %-20s %8d %9s", u.Name, u.Count, ByteCountSI(u.Bytes))
+	}
+	Log.Info("")
+
+	if suggest {
+		fmt.Print(suggestRules(mailbox, oldTypes.top(3, false), senders.top(3, false)))
+	}
+
+	return nil
+}
+
+// largestMessages returns the largest messages, largest first
+func largestMessages(list []analyzedMessage) []analyzedMessage {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Size > list[j].Size
+	})
+
+	if len(list) > analyzeTop {
+		list = list[:analyzeTop]
+	}
+
+	return list
+}
+
+// printUsage prints a section of the analysis
+func printUsage(title, column string, list []usage) {
+	Log.Info(title)
+	Log.InfoF(" %-50s %8s %9s", column, "Messages", "Size")
+	for _, u := range list {
+		Log.InfoF(" %-50s %8d %9s", Truncate(u.Name, 50), u.Count, ByteCountSI(u.Bytes))
+	}
+	Log.Info("")
+}
+
+// suggestRules returns suggested rules (yaml) to remove the largest attachment types
+// of messages older than a year, and to archive & delete old messages of the largest senders
+func suggestRules(mailbox string, types, senders []usage) string {
+	var b strings.Builder
+
+	b.WriteString("# Suggested rules, please review before use\nrules:\n")
+
+	for _, t := range types {
+		fmt.Fprintf(&b, "  # %d %s attachments older than 1 year, %s\n", t.Count, t.Name, ByteCountSI(t.Bytes))
+		fmt.Fprintf(&b, "  - mailbox: %s\n", yamlString(mailbox))
+		fmt.Fprintf(&b, "    attachment_type: %s\n", yamlString(t.Name))
+		b.WriteString("    older_than: 1y\n")
+		b.WriteString("    actions: save_attachments, remove_attachments\n")
+	}
+
+	for _, s := range senders {
+		if s.Name == "unknown" {
+			continue
+		}
+		fmt.Fprintf(&b, "  # %d messages from %s, %s\n", s.Count, s.Name, ByteCountSI(s.Bytes))
+		fmt.Fprintf(&b, "  - mailbox: %s\n", yamlString(mailbox))
+		fmt.Fprintf(&b, "    from: %s\n", yamlString(s.Name))
+		b.WriteString("    older_than: 1y\n")
+		b.WriteString("    actions: export_mbox, delete\n")
+	}
+
+	return b.String()
+}
+
+// yamlString returns a string as a yaml scalar, quoted if required
+func yamlString(s string) string {
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+// AppendMessage appends a message to a mailbox. If the server supports UIDPLUS (RFC 4315),
+// the UID validity & UID of the new message are returned, else both are zero.
+func AppendMessage(c *client.Client, mailbox string, flags []string, date time.Time, msg imap.Literal) (uidValidity, uid uint32, err error) {
+	cmd := &commands.Append{
+		Mailbox: mailbox,
+		Flags:   flags,
+		Date:    date,
+		Message: msg,
+	}
+
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := status.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	// * OK [APPENDUID <uidvalidity> <uid>] APPEND completed
+	if status.Code == "APPENDUID" && len(status.Arguments) >= 2 {
+		uidValidity, err1 := imap.ParseNumber(status.Arguments[0])
+		uid, err2 := imap.ParseNumber(status.Arguments[1])
+		if err1 == nil && err2 == nil {
+			return uidValidity, uid, nil
+		}
+	}
+
+	return 0, 0, nil
+}
+
+// AppendFlags returns the flags & keywords of a message which can be set when appending
+// a copy of it, excluding \Recent (which cannot be set by clients) and \Deleted
+func AppendFlags(flags []string) []string {
+	result := []string{}
+	for _, f := range flags {
+		if f != imap.RecentFlag && f != imap.DeletedFlag {
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
+
+// VerifyAppend fetches an appended message from the (selected) mailbox, and returns an
+// error unless its size, header & text match the appended message. If the UID is not
+// known (no UIDPLUS), the newest message with the same Message-ID (other than the
+// original) is used. Returns the UID of the verified message, or of the message which
+// failed verification if known.
+func VerifyAppend(c *client.Client, uid uint32, raw []byte, messageID string, originalUID uint32) (uint32, error) {
+	if uid == 0 {
+		if messageID == "" {
+			return 0, fmt.Errorf("cannot verify appended message without UIDPLUS or a Message-ID")
+		}
+
+		crit := imap.NewSearchCriteria()
+		crit.Header.Add("Message-Id", messageID)
+		uids, err := c.UidSearch(crit)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, u := range uids {
+			if u != originalUID && u > uid {
+				uid = u
+			}
+		}
+
+		if uid == 0 {
+			return 0, fmt.Errorf("appended message %s not found", messageID)
+		}
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	header := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	text := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.TextSpecifier}, Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, header.FetchItem(), text.FetchItem()}, messages)
+	}()
+
+	var msg *imap.Message
+	for m := range messages {
+		if m.Uid == uid {
+			msg = m
+		}
+	}
+	if err := <-done; err != nil {
+		return uid, err
+	}
+	if msg == nil {
+		return uid, fmt.Errorf("appended message %d not found", uid)
+	}
+
+	expected := crlf(raw)
+	headerEnd := mimeHeaderEnd(expected)
+
+	if int(msg.Size) != len(expected) {
+		return uid, fmt.Errorf("appended message %d size mismatch: expected %d, got %d", uid, len(expected), msg.Size)
+	}
+
+	verified := 0
+	for section, literal := range msg.Body {
+		if literal == nil {
+			continue
+		}
+		b, err := io.ReadAll(literal)
+		if err != nil {
+			return uid, err
+		}
+
+		switch section.Specifier {
+		case imap.HeaderSpecifier:
+			if !bytes.Equal(crlf(b), expected[:headerEnd]) {
+				return uid, fmt.Errorf("appended message %d header mismatch", uid)
+			}
+			verified++
+		case imap.TextSpecifier:
+			if !bytes.Equal(crlf(b), expected[headerEnd:]) {
+				return uid, fmt.Errorf("appended message %d body mismatch", uid)
+			}
+			verified++
+		}
+	}
+
+	if verified != 2 {
+		return uid, fmt.Errorf("server didn't return appended message %d", uid)
+	}
+
+	return uid, nil
+}
+
+// crlf returns a copy of b with all line endings converted to CRLF
+func crlf(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
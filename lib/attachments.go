@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// HasAttachmentFilter returns whether a rule contains any attachment criteria
+// or attachment keep-lists
+func (r Rule) HasAttachmentFilter() bool {
+	return len(r.AttachmentName) > 0 || len(r.AttachmentType) > 0 || r.MinAttachmentSize > 0 ||
+		r.MinAttachments > 0 || r.MaxAttachments > 0 || len(r.KeepNames) > 0 || len(r.KeepTypes) > 0 || r.KeepSmallerThan > 0
+}
+
+// TargetsAttachment returns whether an attachment should be saved and/or removed,
+// being an attachment matching the rule's criteria which is not in a keep-list
+func (r Rule) TargetsAttachment(filename, mimeType string, size uint64) bool {
+	return r.MatchAttachment(filename, mimeType, size) && !r.KeepAttachment(filename, mimeType, size)
+}
+
+// KeepAttachment returns whether an attachment matches any of the rule's keep-lists
+func (r Rule) KeepAttachment(filename, mimeType string, size uint64) bool {
+	if len(r.KeepNames) > 0 && matchGlobs(r.KeepNames, filename) {
+		return true
+	}
+
+	if len(r.KeepTypes) > 0 && matchGlobs(r.KeepTypes, mimeType) {
+		return true
+	}
+
+	return r.KeepSmallerThan > 0 && size < uint64(r.KeepSmallerThan)
+}
+
+// MatchAttachment returns whether an attachment matches all the rule's attachment
+// criteria. Rules without attachment criteria match all attachments.
+func (r Rule) MatchAttachment(filename, mimeType string, size uint64) bool {
+	if len(r.AttachmentName) > 0 && !matchGlobs(r.AttachmentName, filename) {
+		return false
+	}
+
+	if len(r.AttachmentType) > 0 && !matchGlobs(r.AttachmentType, mimeType) {
+		return false
+	}
+
+	if r.MinAttachmentSize > 0 && size < uint64(r.MinAttachmentSize) {
+		return false
+	}
+
+	return true
+}
+
+// MatchBodyStructure returns whether a message body structure contains at least
+// one (or min_attachments, and at most max_attachments) attachments targeted by the rule
+func (r Rule) MatchBodyStructure(bs *imap.BodyStructure) bool {
+	count := r.CountAttachments(bs)
+
+	if count == 0 || count < r.MinAttachments {
+		return false
+	}
+
+	return r.MaxAttachments == 0 || count <= r.MaxAttachments
+}
+
+// CountAttachments returns the number of attachments in a message body structure
+// targeted by the rule
+func (r Rule) CountAttachments(bs *imap.BodyStructure) int {
+	count := 0
+
+	bs.Walk(func(p []int, part *imap.BodyStructure) bool {
+		if len(part.Parts) > 0 {
+			return true
+		}
+
+		mimeType := strings.ToLower(part.MIMEType + "/" + part.MIMESubType)
+		if !isAttachment(mimeType, strings.ToLower(part.Disposition)) {
+			return true
+		}
+
+		filename, _ := part.Filename()
+		if r.TargetsAttachment(filename, mimeType, decodedSize(part)) {
+			count++
+		}
+
+		return true
+	})
+
+	return count
+}
+
+// attachmentNames returns the filenames (or MIME types, if unnamed) of all
+// attachments in a message body structure
+func attachmentNames(bs *imap.BodyStructure) []string {
+	names := []string{}
+	if bs == nil {
+		return names
+	}
+
+	bs.Walk(func(p []int, part *imap.BodyStructure) bool {
+		if len(part.Parts) > 0 {
+			return true
+		}
+
+		mimeType := strings.ToLower(part.MIMEType + "/" + part.MIMESubType)
+		if !isAttachment(mimeType, strings.ToLower(part.Disposition)) {
+			return true
+		}
+
+		filename, _ := part.Filename()
+		if filename == "" {
+			filename = mimeType
+		}
+		names = append(names, filename)
+
+		return true
+	})
+
+	return names
+}
+
+// decodedSize returns the (estimated) decoded size of a body structure part
+func decodedSize(part *imap.BodyStructure) uint64 {
+	size := uint64(part.Size)
+	if strings.EqualFold(part.Encoding, "base64") {
+		size = size * 3 / 4
+	}
+
+	return size
+}
+
+// FilterByAttachments returns the UIDs of messages containing attachments
+// targeted by the rule
+func FilterByAttachments(c *client.Client, rule Rule, uids []uint32) ([]uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure}, messages)
+	}()
+
+	matched := []uint32{}
+	for msg := range messages {
+		if msg.BodyStructure != nil && rule.MatchBodyStructure(msg.BodyStructure) {
+			matched = append(matched, msg.Uid)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return matched, nil
+}
+
+// isAttachment returns whether a message part is treated as an attachment,
+// being any non-text part, or text part with an attachment disposition
+func isAttachment(mimeType, disposition string) bool {
+	if disposition == "attachment" || strings.HasPrefix(mimeType, "image/") {
+		return true
+	}
+
+	return disposition != "inline" && !strings.HasPrefix(mimeType, "text/")
+}
+
+// matchGlobs returns whether a value matches any of the (case-insensitive) glob patterns
+func matchGlobs(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), value); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestMatchBodyStructure(t *testing.T) {
+	part := func(mimeType, subType, disposition, filename string, size uint32) *imap.BodyStructure {
+		return &imap.BodyStructure{
+			MIMEType:          mimeType,
+			MIMESubType:       subType,
+			Disposition:       disposition,
+			DispositionParams: map[string]string{"filename": filename},
+			Size:              size,
+		}
+	}
+
+	bs := &imap.BodyStructure{
+		MIMEType:    "multipart",
+		MIMESubType: "mixed",
+		Parts: []*imap.BodyStructure{
+			part("text", "plain", "", "", 100),
+			part("application", "pdf", "attachment", "a.pdf", 200000),
+			part("application", "pdf", "attachment", "b.pdf", 2000),
+			part("image", "png", "inline", "logo.png", 1000),
+		},
+	}
+
+	tests := []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{"any attachment", Rule{MinAttachments: 1}, true},
+		{"min attachments", Rule{MinAttachments: 3}, true},
+		{"too few attachments", Rule{MinAttachments: 4}, false},
+		{"max attachments", Rule{MaxAttachments: 3}, true},
+		{"too many attachments", Rule{MaxAttachments: 2}, false},
+		{"count by name", Rule{AttachmentName: StringList{"*.pdf"}, MinAttachments: 2}, true},
+		{"count by size", Rule{AttachmentName: StringList{"*.pdf"}, MinAttachmentSize: 10 << 10, MinAttachments: 2}, false},
+		{"count excludes kept", Rule{KeepTypes: StringList{"image/*"}, MaxAttachments: 2}, true},
+		{"no matching attachment", Rule{AttachmentType: StringList{"video/*"}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.MatchBodyStructure(bs); got != tt.want {
+			t.Errorf("%s: MatchBodyStructure() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// BackupInfo is the sidecar JSON written alongside each message backup
+type BackupInfo struct {
+	Mailbox      string    `json:"mailbox"`
+	UID          uint32    `json:"uid"`
+	UIDValidity  uint32    `json:"uid_validity"`
+	Flags        []string  `json:"flags"`
+	Labels       []string  `json:"labels,omitempty"`
+	InternalDate time.Time `json:"internal_date"`
+	Date         time.Time `json:"date"`
+	Subject      string    `json:"subject"`
+	MessageID    string    `json:"message_id"`
+	Size         uint32    `json:"size"`
+}
+
+// BackupMessage writes the original message to <backup_path>/<mailbox>/<uidvalidity>-<uid>.eml,
+// with a sidecar .json file containing the mailbox, UID, flags, Gmail labels & internal date.
+// Returns the path of the .eml file.
+func BackupMessage(msg *imap.Message, mailbox string, uidValidity uint32) (string, error) {
+	raw, err := messageBody(msg)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%d-%d", uidValidity, msg.Uid)
+
+	outFile, err := savePath(Config.BackupPath, mailbox, name+".eml")
+	if err != nil {
+		return "", err
+	}
+
+	info := BackupInfo{
+		Mailbox:      mailbox,
+		UID:          msg.Uid,
+		UIDValidity:  uidValidity,
+		Flags:        msg.Flags,
+		Labels:       GmailLabels(msg),
+		InternalDate: msg.InternalDate,
+		Size:         msg.Size,
+	}
+	if msg.Envelope != nil {
+		info.Date = msg.Envelope.Date
+		info.Subject = msg.Envelope.Subject
+		info.MessageID = msg.Envelope.MessageId
+	}
+
+	j, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFile(outFile, raw, MessageDate(msg), 0600); err != nil {
+		return "", err
+	}
+
+	if err := writeFile(outFile[:len(outFile)-len(path.Ext(outFile))]+".json", j, time.Now(), 0600); err != nil {
+		return "", err
+	}
+
+	return outFile, nil
+}
+
+// ReadBackup returns the original message and sidecar information of a backup
+func ReadBackup(emlFile string) ([]byte, BackupInfo, error) {
+	info := BackupInfo{}
+
+	// #nosec
+	raw, err := os.ReadFile(emlFile)
+	if err != nil {
+		return nil, info, err
+	}
+
+	// #nosec
+	j, err := os.ReadFile(emlFile[:len(emlFile)-len(path.Ext(emlFile))] + ".json")
+	if err != nil {
+		return nil, info, err
+	}
+
+	if err := json.Unmarshal(j, &info); err != nil {
+		return nil, info, err
+	}
+
+	return raw, info, nil
+}
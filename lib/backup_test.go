@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestBackupMessage(t *testing.T) {
+	Config.BackupPath = t.TempDir()
+
+	raw := "Subject: backup\r\n\r\nbody\r\n"
+	msg := &imap.Message{
+		Uid:      42,
+		Flags:    []string{imap.SeenFlag},
+		Size:     uint32(len(raw)),
+		Envelope: &imap.Envelope{Subject: "backup", MessageId: "<id@example.com>"},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			{}: bytes.NewBufferString(raw),
+		},
+	}
+
+	file, err := BackupMessage(msg, "INBOX", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(file, "7-42.eml") {
+		t.Errorf("unexpected backup file %s", file)
+	}
+
+	if runtime.GOOS != "windows" {
+		for _, f := range []string{file, strings.TrimSuffix(file, ".eml") + ".json"} {
+			st, err := os.Stat(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := st.Mode().Perm(); perm != 0600 {
+				t.Errorf("%s has permissions %o, want 600", f, perm)
+			}
+		}
+	}
+
+	b, info, err := ReadBackup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != raw || info.Mailbox != "INBOX" || info.UID != 42 || info.UIDValidity != 7 || info.MessageID != "<id@example.com>" {
+		t.Errorf("unexpected backup %q %+v", b, info)
+	}
+}
@@ -2,9 +2,12 @@
 package lib
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,43 +16,183 @@ var (
 	// Config module global
 	Config = YamlConfig{}
 
+	// Accounts are the configs of all accounts, if the config contains a list of accounts
+	Accounts = []YamlConfig{}
+
 	validActions = map[string]bool{
 		"delete":             true,
 		"save_attachments":   true,
 		"remove_attachments": true,
+		"move":               true,
+		"copy":               true,
+		"mark_read":          true,
+		"mark_unread":        true,
+		"flag":               true,
+		"unflag":             true,
+		"add_keyword":        true,
+		"remove_keyword":     true,
+		"export_mbox":        true,
+		"export_maildir":     true,
+		"export_eml":         true,
+	}
+
+	// actions requiring a value, eg: move:Archive
+	valueActions = map[string]bool{
+		"move":           true,
+		"copy":           true,
+		"add_keyword":    true,
+		"remove_keyword": true,
+	}
+
+	// actions with an optional value, and their accepted values
+	optionalValueActions = map[string][]string{
+		"export_mbox": {"year"},
 	}
 )
 
 // YamlConfig config struct
 type YamlConfig struct {
-	Name     string `yaml:"name"`
-	Host     string `yaml:"host"`
-	SSL      *bool  `yaml:"ssl"`
-	Port     *int   `yaml:"port"`
-	User     string `yaml:"user"`
-	Pass     string `yaml:"pass"`
-	SavePath string `yaml:"save_path"`
-	UseTrash bool   `yaml:"use_trash"`
-	Rules    []Rule `yaml:"rules"`
+	Name        string `yaml:"name"`
+	Host        string `yaml:"host"`
+	SSL         *bool  `yaml:"ssl"` // deprecated, see tls
+	Port        *int   `yaml:"port"`
+	User        string `yaml:"user"`
+	Pass        string `yaml:"pass"`
+	PassEnv     string `yaml:"pass_env"`     // environment variable containing the password
+	PassFile    string `yaml:"pass_file"`    // file containing the password
+	PassCommand string `yaml:"pass_command"` // command returning the password
+
+	// TLS options
+	TLS                string `yaml:"tls"` // implicit (default), starttls or none
+	CAFile             string `yaml:"ca_file"`
+	ClientCert         string `yaml:"client_cert"`
+	ClientKey          string `yaml:"client_key"`
+	ServerName         string `yaml:"server_name"`
+	MinTLSVersion      string `yaml:"min_tls_version"` // default 1.2
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	AllowPlaintextAuth bool   `yaml:"allow_plaintext_auth"` // allow logging in without TLS
+
+	// OAuth2 authentication (auth: xoauth2 or oauthbearer)
+	Auth         string `yaml:"auth"`
+	TokenFile    string `yaml:"token_file"` // file containing an access token
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+	TokenURL     string `yaml:"token_url"`
+	SavePath     string `yaml:"save_path"`
+	ArchivePath  string `yaml:"archive_path"`
+	BackupPath   string `yaml:"backup_path"`
+	UseTrash     bool   `yaml:"use_trash"`
+	Rules        []Rule `yaml:"rules"`
+
+	// names of shared rule sets (rule_sets) whose rules are added to the rules
+	UseRuleSets StringList `yaml:"use_rule_sets"`
+
+	// number of accounts processed at the same time
+	Concurrency int `yaml:"concurrency"`
+
+	// stop processing rules once the storage quota usage is below a percentage
+	UntilQuotaBelow Percent `yaml:"until_quota_below"`
+	QuotaOrder      string  `yaml:"quota_order"` // oldest (default) or largest
 }
 
 // Rule struct
 type Rule struct {
-	Mailbox        string `yaml:"mailbox"`
-	Size           uint32 `yaml:"min_size"`   // KB
-	OlderThan      int    `yaml:"older_than"` // days
-	From           string `yaml:"from"`
-	To             string `yaml:"to"`
-	Subject        string `yaml:"subject"`
-	Body           string `yaml:"body"`
-	Text           string `yaml:"text"`
-	Actions        string `yaml:"actions"`
-	IncludeUnread  bool   `yaml:"include_unread"`
-	IncludeStarred bool   `yaml:"include_starred"`
-}
-
-// ReadConfig reads & parses the config into global config
-func ReadConfig(file string) {
+	Mailbox        string     `yaml:"mailbox"`
+	MinSize        ByteSize   `yaml:"min_size"`   // kB, or size eg: 5MB
+	MaxSize        ByteSize   `yaml:"max_size"`   // kB, or size eg: 200k
+	OlderThan      DateValue  `yaml:"older_than"` // days, duration or date
+	NewerThan      DateValue  `yaml:"newer_than"` // days, duration or date
+	Before         DateValue  `yaml:"before"`     // date or duration
+	Since          DateValue  `yaml:"since"`      // date or duration
+	InternalDate   bool       `yaml:"internal_date"`
+	From           StringList `yaml:"from"`
+	To             StringList `yaml:"to"`
+	Subject        StringList `yaml:"subject"`
+	Body           string     `yaml:"body"`
+	Text           string     `yaml:"text"`
+	Actions        string     `yaml:"actions"`
+	IncludeUnread  bool       `yaml:"include_unread"`
+	IncludeStarred bool       `yaml:"include_starred"`
+	Match          *Match     `yaml:"match"`
+
+	// attachment criteria, matched against the message body structure
+	AttachmentName    StringList `yaml:"attachment_name"` // filename glob, eg: *.pdf
+	AttachmentType    StringList `yaml:"attachment_type"` // MIME type glob, eg: image/*
+	MinAttachmentSize ByteSize   `yaml:"min_attachment_size"`
+	MinAttachments    int        `yaml:"min_attachments"` // number of matching attachments
+	MaxAttachments    int        `yaml:"max_attachments"`
+
+	// attachments which are never saved or removed
+	KeepNames       StringList `yaml:"keep_names"` // filename glob, eg: *.ics
+	KeepTypes       StringList `yaml:"keep_types"` // MIME type glob, eg: text/calendar
+	KeepSmallerThan ByteSize   `yaml:"keep_smaller_than"`
+
+	// client-side regular expression filters, applied to the search results
+	FromRegex    string            `yaml:"from_regex"`
+	ToRegex      string            `yaml:"to_regex"`
+	SubjectRegex string            `yaml:"subject_regex"`
+	HeaderRegex  map[string]string `yaml:"header_regex"`
+
+	actions []Action
+
+	fromRegex    *regexp.Regexp
+	toRegex      *regexp.Regexp
+	subjectRegex *regexp.Regexp
+	headerRegex  map[string]*regexp.Regexp
+}
+
+// Action is a rule action with an optional value, eg: move:Archive
+type Action struct {
+	Name  string
+	Value string
+}
+
+// StringList is a list of strings which can be set in yaml either as
+// a single string, or as a list of strings
+type StringList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var v string
+		if err := value.Decode(&v); err != nil {
+			return err
+		}
+		*s = StringList{}
+		if v != "" {
+			*s = StringList{v}
+		}
+		return nil
+	}
+
+	var v []string
+	if err := value.Decode(&v); err != nil {
+		return err
+	}
+
+	*s = StringList{}
+	for _, item := range v {
+		if item != "" {
+			*s = append(*s, item)
+		}
+	}
+
+	return nil
+}
+
+// configFile is the yaml config file, containing either a single account, or a list
+// of accounts using the top-level options as defaults
+type configFile struct {
+	YamlConfig `yaml:",inline"`
+	RuleSets   map[string][]Rule `yaml:"rule_sets"`
+	Accounts   []yaml.Node       `yaml:"accounts"`
+}
+
+// ReadConfig reads & parses the config into global config. If the config contains
+// a list of accounts, all accounts are parsed into Accounts, and the named account
+// (if any) into the global config.
+func ReadConfig(file, account string) {
 	file = path.Clean(file)
 	// #nosec
 	yamlData, err := os.ReadFile(file)
@@ -57,21 +200,145 @@ func ReadConfig(file string) {
 		panic(err)
 	}
 
-	err = yaml.Unmarshal(yamlData, &Config)
+	root := yaml.Node{}
+	cf := configFile{}
+	err = yaml.Unmarshal(yamlData, &root)
+	if err == nil {
+		err = expandEnv(&root)
+	}
+	if err == nil {
+		err = root.Decode(&cf)
+	}
 
 	if err != nil {
 		Log.ErrorF("Error parsing %s:\n\n%s\n\n", file, err)
 		os.Exit(2)
 	}
 
-	if Config.User == "" || Config.Pass == "" || Config.Host == "" {
+	if len(cf.Accounts) == 0 {
+		if account != "" {
+			Log.ErrorF("%s does not contain any accounts", file)
+			os.Exit(2)
+		}
+
+		Config = cf.YamlConfig
+		Config.Rules = addRuleSets(Config.Rules, Config.UseRuleSets, cf.RuleSets)
+		validateConfig()
+		useAccount()
+		return
+	}
+
+	base := cf.YamlConfig
+	Accounts = []YamlConfig{}
+
+	for _, node := range cf.Accounts {
+		acc := base
+		acc.Rules = append([]Rule{}, base.Rules...)
+		acc.UseRuleSets = append(StringList{}, base.UseRuleSets...)
+		acc.Name = ""
+
+		// yaml decodes into existing pointers, so never share them with other accounts
+		if base.SSL != nil {
+			ssl := *base.SSL
+			acc.SSL = &ssl
+		}
+		if base.Port != nil {
+			port := *base.Port
+			acc.Port = &port
+		}
+
+		if err := node.Decode(&acc); err != nil {
+			Log.ErrorF("Error parsing %s:\n\n%s\n\n", file, err)
+			os.Exit(2)
+		}
+
+		if acc.Name == "" {
+			Log.Error("You must specify a name for every account")
+			os.Exit(2)
+		}
+
+		for _, a := range Accounts {
+			if strings.EqualFold(a.Name, acc.Name) {
+				Log.ErrorF("Account names must be unique: \"%s\"", acc.Name)
+				os.Exit(2)
+			}
+		}
+
+		// keep the files of each account apart when sharing the default paths
+		dir := fileNameReplacer.Replace(acc.Name)
+		for _, p := range []struct{ account, base *string }{
+			{&acc.SavePath, &base.SavePath}, {&acc.ArchivePath, &base.ArchivePath}, {&acc.BackupPath, &base.BackupPath},
+		} {
+			if *p.base != "" && *p.account == *p.base {
+				*p.account = path.Join(*p.base, dir)
+			}
+		}
+
+		acc.Rules = addRuleSets(acc.Rules, acc.UseRuleSets, cf.RuleSets)
+
+		Config = acc
+		validateConfig()
+		Accounts = append(Accounts, Config)
+	}
+
+	Config = base
+
+	if account != "" {
+		found := false
+		for _, acc := range Accounts {
+			if strings.EqualFold(acc.Name, account) {
+				Config, found = acc, true
+			}
+		}
+		if !found {
+			Log.ErrorF("Account \"%s\" not found in %s", account, file)
+			os.Exit(2)
+		}
+		useAccount()
+	}
+}
+
+// useAccount prepares the global config for connecting to the account
+func useAccount() {
+	if Config.Auth != "login" {
+		return
+	}
+
+	if err := resolvePassword(); err != nil {
+		Log.Error(err.Error())
+		os.Exit(2)
+	}
+}
+
+// addRuleSets returns the rules with the rules of the named rule sets added
+func addRuleSets(rules []Rule, names []string, ruleSets map[string][]Rule) []Rule {
+	for _, name := range names {
+		set, ok := ruleSets[name]
+		if !ok {
+			Log.ErrorF("Rule set \"%s\" not found in rule_sets", name)
+			os.Exit(2)
+		}
+		rules = append(rules, set...)
+	}
+
+	return rules
+}
+
+// validateConfig validates the global config & sets the defaults
+func validateConfig() {
+	if Config.User == "" || Config.Host == "" {
 		Log.Error("Please ensure host, user & password are set")
 		os.Exit(2)
 	}
 
-	if Config.SSL == nil {
-		ssl := true
-		Config.SSL = &ssl
+	if err := validateAuth(); err != nil {
+		Log.Error(err.Error())
+		os.Exit(2)
+	}
+
+	if err := validateTLS(); err != nil {
+		Log.Error(err.Error())
+		os.Exit(2)
 	}
 
 	if Config.Port == nil {
@@ -82,10 +349,16 @@ func ReadConfig(file string) {
 		Config.Port = &port
 	}
 
-	// change kB to bytes
-	for x, item := range Config.Rules {
-		Config.Rules[x].Size = item.Size * 1024
+	Config.QuotaOrder = strings.ToLower(strings.TrimSpace(Config.QuotaOrder))
+	if Config.QuotaOrder == "" {
+		Config.QuotaOrder = "oldest"
+	}
+	if Config.QuotaOrder != "oldest" && Config.QuotaOrder != "largest" {
+		Log.Error("quota_order must be either oldest or largest")
+		os.Exit(2)
+	}
 
+	for x, item := range Config.Rules {
 		if item.Mailbox == "" {
 			Log.Error("You must specify a mailbox for every rule")
 			os.Exit(2)
@@ -96,37 +369,211 @@ func ReadConfig(file string) {
 			os.Exit(2)
 		}
 
-		raw := strings.ToLower(item.Actions)
-		rawActions := strings.Split(raw, ",")
-		actions := []string{}
-		for _, a := range rawActions {
-			a = strings.TrimSpace(a)
-			if _, ok := validActions[a]; !ok {
-				Log.ErrorF("\"%s\" is not a valid action", a)
-				os.Exit(2)
+		actions, err := parseActions(item.Actions)
+		if err != nil {
+			Log.Error(err.Error())
+			os.Exit(2)
+		}
+		Config.Rules[x].actions = actions
+		normalized := []string{}
+		for _, a := range actions {
+			if a.Value != "" {
+				normalized = append(normalized, a.Name+":"+a.Value)
+			} else {
+				normalized = append(normalized, a.Name)
 			}
-			actions = append(actions, a)
 		}
-		Config.Rules[x].Actions = strings.Join(actions, ", ")
+		Config.Rules[x].Actions = strings.Join(normalized, ", ")
 
 		if Config.Rules[x].Delete() && Config.Rules[x].RemoveAttachments() {
 			Log.Error("Your rule cannot contain both remove_attachments and delete")
 			os.Exit(2)
 		}
+
+		if Config.Rules[x].MoveTo() != "" && (Config.Rules[x].Delete() || Config.Rules[x].RemoveAttachments()) {
+			Log.Error("Your rule cannot contain move with either remove_attachments or delete")
+			os.Exit(2)
+		}
+
+		if err := Config.Rules[x].validateFlags(); err != nil {
+			Log.Error(err.Error())
+			os.Exit(2)
+		}
+
+		if item.MaxSize > 0 && item.MaxSize <= item.MinSize {
+			Log.Error("Your rule max_size must be larger than min_size")
+			os.Exit(2)
+		}
+
+		if !item.Since.IsZero() && !item.Before.IsZero() && !item.Since.Time(time.Now()).Before(item.Before.Time(time.Now())) {
+			Log.Error("Your rule \"since\" date must be before the \"before\" date")
+			os.Exit(2)
+		}
+
+		if item.Match != nil {
+			if err := item.Match.validate(); err != nil {
+				Log.ErrorF("Invalid match in rule: %s", err)
+				os.Exit(2)
+			}
+		}
+
+		// keep-lists also limit which messages are selected, so would silently
+		// change the messages deleted or moved by other actions
+		if (len(item.KeepNames) > 0 || len(item.KeepTypes) > 0 || item.KeepSmallerThan > 0) &&
+			!Config.Rules[x].SaveAttachments() && !Config.Rules[x].RemoveAttachments() {
+			Log.Error("Your rule keep_names, keep_types & keep_smaller_than require save_attachments or remove_attachments")
+			os.Exit(2)
+		}
+
+		if item.MinAttachments < 0 || item.MaxAttachments < 0 {
+			Log.Error("Your rule min_attachments & max_attachments cannot be negative")
+			os.Exit(2)
+		}
+
+		if item.MaxAttachments > 0 && item.MaxAttachments < item.MinAttachments {
+			Log.Error("Your rule max_attachments cannot be less than min_attachments")
+			os.Exit(2)
+		}
+
+		globs := []string{}
+		for _, l := range []StringList{item.AttachmentName, item.AttachmentType, item.KeepNames, item.KeepTypes} {
+			globs = append(globs, l...)
+		}
+		for _, g := range globs {
+			if _, err := path.Match(g, ""); err != nil {
+				Log.ErrorF("Invalid attachment pattern \"%s\" in rule: %s", g, err)
+				os.Exit(2)
+			}
+		}
+
+		if err := Config.Rules[x].compileRegex(); err != nil {
+			Log.ErrorF("Invalid regular expression in rule: %s", err)
+			os.Exit(2)
+		}
+	}
+}
+
+// parseActions parses & validates a comma-separated list of rule actions
+func parseActions(raw string) ([]Action, error) {
+	actions := []Action{}
+	moves := 0
+
+	for _, a := range strings.Split(raw, ",") {
+		name, value, _ := strings.Cut(a, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+
+		if _, ok := validActions[name]; !ok {
+			return nil, fmt.Errorf("\"%s\" is not a valid action", strings.TrimSpace(a))
+		}
+
+		if valueActions[name] && value == "" {
+			return nil, fmt.Errorf("\"%s\" requires a value, eg: %s:Archive", name, name)
+		}
+
+		if opts, ok := optionalValueActions[name]; ok && value != "" {
+			value = strings.ToLower(value)
+			if !InStringSlice(value, opts) {
+				return nil, fmt.Errorf("\"%s\" is not a valid value for %s, must be one of: %s", value, name, strings.Join(opts, ", "))
+			}
+		} else if !valueActions[name] && value != "" {
+			return nil, fmt.Errorf("\"%s\" does not accept a value", name)
+		}
+
+		if name == "move" {
+			moves++
+			if moves > 1 {
+				return nil, fmt.Errorf("a rule can only contain one move action")
+			}
+		}
+
+		actions = append(actions, Action{name, value})
+	}
+
+	return actions, nil
+}
+
+// hasAction returns whether a rule contains an action
+func (r Rule) hasAction(name string) bool {
+	for _, a := range r.actions {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// actionValues returns the values of all matching rule actions
+func (r Rule) actionValues(name string) []string {
+	values := []string{}
+	for _, a := range r.actions {
+		if a.Name == name {
+			values = append(values, a.Value)
+		}
 	}
+	return values
 }
 
 // Delete returns whether a rule is set to delete messages
 func (r Rule) Delete() bool {
-	return strings.Contains(r.Actions, "delete")
+	return r.hasAction("delete")
 }
 
 // RemoveAttachments returns whether a rule is set to delete messages
 func (r Rule) RemoveAttachments() bool {
-	return strings.Contains(r.Actions, "remove_attachments")
+	return r.hasAction("remove_attachments")
 }
 
 // SaveAttachments returns whether a rule is set to delete messages
 func (r Rule) SaveAttachments() bool {
-	return strings.Contains(r.Actions, "save_attachments")
+	return r.hasAction("save_attachments")
+}
+
+// ExportMbox returns whether a rule is set to export messages to mbox, and whether
+// the mbox files are split by year
+func (r Rule) ExportMbox() (export, perYear bool) {
+	for _, a := range r.actions {
+		if a.Name == "export_mbox" {
+			return true, a.Value == "year"
+		}
+	}
+	return false, false
+}
+
+// ExportMaildir returns whether a rule is set to export messages to a Maildir
+func (r Rule) ExportMaildir() bool {
+	return r.hasAction("export_maildir")
+}
+
+// ExportEml returns whether a rule is set to save messages as .eml files
+func (r Rule) ExportEml() bool {
+	return r.hasAction("export_eml")
+}
+
+// Destructive returns whether a rule is set to remove or rewrite the original messages
+func (r Rule) Destructive() bool {
+	return r.Delete() || r.RemoveAttachments() || r.MoveTo() != ""
+}
+
+// NeedsBody returns whether the rule actions require the full message body
+func (r Rule) NeedsBody() bool {
+	if Config.BackupPath != "" && r.Destructive() {
+		return true
+	}
+
+	export, _ := r.ExportMbox()
+	return r.RemoveAttachments() || r.SaveAttachments() || export || r.ExportMaildir() || r.ExportEml()
+}
+
+// MoveTo returns the (template) mailbox a rule is set to move messages to, if any
+func (r Rule) MoveTo() string {
+	if v := r.actionValues("move"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// CopyTo returns the (template) mailboxes a rule is set to copy messages to
+func (r Rule) CopyTo() []string {
+	return r.actionValues("copy")
 }
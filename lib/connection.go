@@ -1,19 +1,42 @@
 package lib
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/emersion/go-imap/client"
 )
 
+var (
+	// TLS modes: implicit TLS, STARTTLS or plaintext
+	tlsModes = []string{"implicit", "starttls", "none"}
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
 // Connect returns a *client.Client
 func Connect() *client.Client {
 	imapServer := fmt.Sprintf("%s:%d", Config.Host, *Config.Port)
 	var c *client.Client
 	var err error
-	if *Config.SSL {
-		c, err = client.DialTLS(imapServer, nil)
+
+	tlsConfig, err := TLSConfig()
+	if err != nil {
+		Log.ErrorF("%v", err)
+		os.Exit(2)
+	}
+
+	if Config.TLS == "implicit" {
+		c, err = client.DialTLS(imapServer, tlsConfig)
 		if err != nil {
 			Log.ErrorF("%v", err)
 			os.Exit(2)
@@ -26,5 +49,89 @@ func Connect() *client.Client {
 		}
 	}
 
+	if Config.TLS == "starttls" {
+		if ok, _ := c.SupportStartTLS(); !ok {
+			Log.ErrorF("%s does not support STARTTLS", Config.Host)
+			os.Exit(2)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			Log.ErrorF("%v", err)
+			os.Exit(2)
+		}
+	}
+
 	return c
 }
+
+// TLSConfig returns the TLS config for the connection
+func TLSConfig() (*tls.Config, error) {
+	// #nosec
+	tlsConfig := &tls.Config{
+		ServerName:         Config.Host,
+		MinVersion:         tlsVersions[Config.MinTLSVersion],
+		InsecureSkipVerify: Config.InsecureSkipVerify,
+	}
+
+	if Config.ServerName != "" {
+		tlsConfig.ServerName = Config.ServerName
+	}
+
+	if Config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		// #nosec
+		pem, err := os.ReadFile(path.Clean(Config.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no certificates found in %s", Config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if Config.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(Config.ClientCert, Config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client_cert: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// validateTLS validates the TLS options of the global config & sets the defaults.
+// The legacy ssl option is used if tls is not set.
+func validateTLS() error {
+	Config.TLS = strings.ToLower(strings.TrimSpace(Config.TLS))
+	if Config.TLS == "" {
+		Config.TLS = "implicit"
+		if Config.SSL != nil && !*Config.SSL {
+			Config.TLS = "none"
+		}
+	}
+
+	if !InStringSlice(Config.TLS, tlsModes) {
+		return fmt.Errorf("\"%s\" is not a valid tls mode, must be one of: %s", Config.TLS, strings.Join(tlsModes, ", "))
+	}
+
+	ssl := Config.TLS == "implicit"
+	Config.SSL = &ssl
+
+	if Config.MinTLSVersion == "" {
+		Config.MinTLSVersion = "1.2"
+	}
+	if _, ok := tlsVersions[Config.MinTLSVersion]; !ok {
+		return fmt.Errorf("\"%s\" is not a valid min_tls_version, must be one of: 1.0, 1.1, 1.2, 1.3", Config.MinTLSVersion)
+	}
+
+	if (Config.ClientCert == "") != (Config.ClientKey == "") {
+		return fmt.Errorf("client_cert & client_key must be set together")
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	durationRe     = regexp.MustCompile(`^(\d+\s*[a-z]+\s*)+$`)
+	durationPartRe = regexp.MustCompile(`(\d+)\s*([a-z]+)`)
+
+	dateFormats = []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339}
+)
+
+// DateValue is a rule date, set in yaml as either an absolute date (2023-01-31),
+// a number of days (365), or a duration relative to now (6w, 18mo, 2y, 1y6mo)
+type DateValue struct {
+	raw    string
+	date   time.Time
+	years  int
+	months int
+	days   int
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *DateValue) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid date or duration", value.Line)
+	}
+
+	v, err := ParseDateValue(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+
+	*d = v
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (d DateValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.raw)
+}
+
+// ParseDateValue parses a date, number of days or duration
+func ParseDateValue(s string) (DateValue, error) {
+	d := DateValue{raw: strings.TrimSpace(s)}
+	raw := strings.ToLower(d.raw)
+
+	if raw == "" {
+		return d, nil
+	}
+
+	if days, err := strconv.Atoi(raw); err == nil {
+		if days < 0 {
+			return d, fmt.Errorf("invalid number of days \"%s\"", s)
+		}
+		d.days = days
+		return d, nil
+	}
+
+	for _, f := range dateFormats {
+		if t, err := time.ParseInLocation(f, d.raw, time.Local); err == nil {
+			d.date = t
+			return d, nil
+		}
+	}
+
+	if !durationRe.MatchString(raw) {
+		return d, fmt.Errorf("invalid date or duration \"%s\"", s)
+	}
+
+	for _, m := range durationPartRe.FindAllStringSubmatch(raw, -1) {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "d", "day", "days":
+			d.days += n
+		case "w", "wk", "week", "weeks":
+			d.days += n * 7
+		case "m", "mo", "month", "months":
+			d.months += n
+		case "y", "yr", "year", "years":
+			d.years += n
+		default:
+			return d, fmt.Errorf("invalid duration unit \"%s\" in \"%s\"", m[2], s)
+		}
+	}
+
+	return d, nil
+}
+
+// IsZero returns whether the date has not been set (or is 0 days)
+func (d DateValue) IsZero() bool {
+	return d.date.IsZero() && d.years == 0 && d.months == 0 && d.days == 0
+}
+
+// Time returns the absolute time of the date value, relative to now
+func (d DateValue) Time(now time.Time) time.Time {
+	if !d.date.IsZero() {
+		return d.date
+	}
+
+	return now.AddDate(-d.years, -d.months, -d.days)
+}
+
+// String returns a human-readable representation of the date value
+func (d DateValue) String() string {
+	if _, err := strconv.Atoi(d.raw); err == nil {
+		return fmt.Sprintf("%s days", d.raw)
+	}
+
+	return d.raw
+}
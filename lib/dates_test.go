@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateValue(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{"", now, false},
+		{"0", now, false},
+		{"30", now.AddDate(0, 0, -30), false},
+		{"2023-01-31", time.Date(2023, 1, 31, 0, 0, 0, 0, time.Local), false},
+		{"2023-01-31 10:30:00", time.Date(2023, 1, 31, 10, 30, 0, 0, time.Local), false},
+		{"2023-01-31T10:30:00Z", time.Date(2023, 1, 31, 10, 30, 0, 0, time.UTC), false},
+		{"5d", now.AddDate(0, 0, -5), false},
+		{"6w", now.AddDate(0, 0, -42), false},
+		{"2 weeks", now.AddDate(0, 0, -14), false},
+		{"3m", now.AddDate(0, -3, 0), false}, // months, not minutes
+		{"18mo", now.AddDate(0, -18, 0), false},
+		{"2y", now.AddDate(-2, 0, 0), false},
+		{"1y6mo", now.AddDate(-1, -6, 0), false},
+		{"1Y 6MO", now.AddDate(-1, -6, 0), false},
+		{"-5", time.Time{}, true},
+		{"5h", time.Time{}, true},
+		{"1y6", time.Time{}, true},
+		{"y", time.Time{}, true},
+		{"2023-13-01", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		d, err := ParseDateValue(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseDateValue(%q) expected an error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDateValue(%q) unexpected error: %s", tt.in, err)
+			continue
+		}
+		if got := d.Time(now); !got.Equal(tt.want) {
+			t.Errorf("ParseDateValue(%q).Time() = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDateValueIsZero(t *testing.T) {
+	for in, want := range map[string]bool{"": true, "0": true, "0d": true, "1": false, "1y": false, "2023-01-31": false} {
+		d, err := ParseDateValue(in)
+		if err != nil {
+			t.Fatalf("ParseDateValue(%q) unexpected error: %s", in, err)
+		}
+		if d.IsZero() != want {
+			t.Errorf("ParseDateValue(%q).IsZero() = %v, want %v", in, d.IsZero(), want)
+		}
+	}
+}
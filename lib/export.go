@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	// lines requiring escaping in mboxrd format
+	mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+	// characters which are replaced in file & directory names
+	fileNameReplacer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_")
+)
+
+// ExportMbox appends a message to an mbox (mboxrd) file in the archive path,
+// either per mailbox (<mailbox>.mbox) or per year (<mailbox>/<year>.mbox).
+// Returns the path of the mbox file.
+func ExportMbox(msg *imap.Message, mailbox string, perYear bool) (string, error) {
+	raw, err := messageBody(msg)
+	if err != nil {
+		return "", err
+	}
+
+	name := fileNameReplacer.Replace(mailbox)
+	outFile := path.Join(Config.ArchivePath, name+".mbox")
+	if perYear {
+		outFile = path.Join(Config.ArchivePath, name, MessageDate(msg).Format("2006")+".mbox")
+	}
+	outFile = path.Clean(outFile)
+
+	if err := CreateDir(path.Dir(outFile)); err != nil {
+		return outFile, err
+	}
+
+	sender := "MAILER-DAEMON"
+	if msg.Envelope != nil && len(msg.Envelope.From) > 0 && msg.Envelope.From[0].Address() != "" {
+		sender = msg.Envelope.From[0].Address()
+	}
+
+	date := msg.InternalDate
+	if date.IsZero() {
+		date = MessageDate(msg)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", sender, date.UTC().Format("Mon Jan _2 15:04:05 2006"))
+
+	body := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	b.Write(mboxFromRe.ReplaceAll(body, []byte(">$1")))
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	// #nosec
+	file, err := os.OpenFile(outFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return outFile, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(b.Bytes()); err != nil {
+		return outFile, err
+	}
+
+	return outFile, nil
+}
+
+// ExportMaildir writes a message to a Maildir in the archive path (<mailbox>/{tmp,new,cur}).
+// Messages with flags are stored in cur/ with the Maildir flags suffix, else in new/.
+// Returns the path of the message file.
+func ExportMaildir(msg *imap.Message, mailbox string) (string, error) {
+	raw, err := messageBody(msg)
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Clean(path.Join(Config.ArchivePath, fileNameReplacer.Replace(mailbox)))
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := CreateDir(path.Join(dir, sub)); err != nil {
+			return "", err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+
+	b := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+
+	name := fmt.Sprintf("%d.U%dP%d_%x.%s", time.Now().Unix(), msg.Uid, os.Getpid(), contentHash(b), hostname)
+
+	tmpFile := path.Join(dir, "tmp", name)
+	if err := writeFile(tmpFile, b, MessageDate(msg), 0664); err != nil {
+		return "", err
+	}
+
+	outFile := path.Join(dir, "new", name)
+	if flags := maildirFlags(msg.Flags); flags != "" {
+		outFile = path.Join(dir, "cur", name+":2,"+flags)
+	}
+
+	if err := os.Rename(tmpFile, outFile); err != nil {
+		return "", err
+	}
+
+	return outFile, nil
+}
+
+// maildirFlags returns the Maildir info flags (sorted) for a list of IMAP flags
+func maildirFlags(flags []string) string {
+	mapped := map[string]string{
+		imap.DraftFlag:    "D",
+		imap.FlaggedFlag:  "F",
+		imap.AnsweredFlag: "R",
+		imap.SeenFlag:     "S",
+		imap.DeletedFlag:  "T",
+	}
+
+	info := []string{}
+	for _, f := range flags {
+		if m, ok := mapped[f]; ok {
+			info = append(info, m)
+		}
+	}
+	sort.Strings(info)
+
+	return strings.Join(info, "")
+}
+
+// SaveEml saves a message to <save_path>/<sender>/<date>-<subject>.eml. If a different
+// message with the same name already exists, a short hash is added to the filename.
+// Returns the output file path.
+func SaveEml(msg *imap.Message) (string, error) {
+	raw, err := messageBody(msg)
+	if err != nil {
+		return "", err
+	}
+
+	emailAddress := "no-email"
+	subject := ""
+	if msg.Envelope != nil {
+		if len(msg.Envelope.From) > 0 {
+			emailAddress = msg.Envelope.From[0].Address()
+		}
+		subject = strings.TrimSpace(msg.Envelope.Subject)
+	}
+	if subject == "" {
+		subject = "no-subject"
+	}
+
+	date := MessageDate(msg)
+	base := fmt.Sprintf("%s-%s", date.Format("2006-01-02"), Truncate(subject, 100))
+
+	outFile, err := savePath(Config.SavePath, emailAddress, base+".eml")
+	if err != nil {
+		return "", err
+	}
+
+	if FileExists(outFile) {
+		// #nosec
+		if existing, err := os.ReadFile(outFile); err == nil && bytes.Equal(existing, raw) {
+			Log.WarningF(" - %s already exists", outFile)
+			return outFile, nil
+		}
+
+		if outFile, err = savePath(Config.SavePath, emailAddress, fmt.Sprintf("%s-%x.eml", base, contentHash(raw))); err != nil {
+			return "", err
+		}
+		if FileExists(outFile) {
+			Log.WarningF(" - %s already exists", outFile)
+			return outFile, nil
+		}
+	}
+
+	if err := writeFile(outFile, raw, date, 0664); err != nil {
+		return outFile, err
+	}
+
+	return outFile, nil
+}
+
+// MessageDate returns the date of a message, falling back to the internal
+// (received) date if the message has no Date header
+func MessageDate(msg *imap.Message) time.Time {
+	if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+		return msg.Envelope.Date
+	}
+
+	return msg.InternalDate
+}
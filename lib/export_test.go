@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestExportMbox(t *testing.T) {
+	Config.ArchivePath = t.TempDir()
+
+	body := "From: sender@example.com\r\n" +
+		"Subject: mboxrd\r\n" +
+		"\r\n" +
+		"From the start of a line\r\n" +
+		">From an escaped line\r\n" +
+		">>From a double escaped line\r\n" +
+		" From with leading space\r\n" +
+		"Fromage is not escaped\r\n" +
+		"no trailing line break"
+
+	msg := &imap.Message{
+		Uid:          1,
+		InternalDate: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		Envelope: &imap.Envelope{
+			From: []*imap.Address{{MailboxName: "sender", HostName: "example.com"}},
+		},
+		Body: map[*imap.BodySectionName]imap.Literal{
+			{}: bytes.NewBufferString(body),
+		},
+	}
+
+	file, err := ExportMbox(msg, "INBOX/Sub", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != path.Join(Config.ArchivePath, "INBOX_Sub.mbox") {
+		t.Errorf("unexpected mbox file %s", file)
+	}
+
+	// a second message is appended
+	if _, err := ExportMbox(msg, "INBOX/Sub", false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "From sender@example.com Mon Jan  2 03:04:05 2023\n" +
+		"From: sender@example.com\n" +
+		"Subject: mboxrd\n" +
+		"\n" +
+		">From the start of a line\n" +
+		">>From an escaped line\n" +
+		">>>From a double escaped line\n" +
+		" From with leading space\n" +
+		"Fromage is not escaped\n" +
+		"no trailing line break\n" +
+		"\n"
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != want+want {
+		t.Errorf("mbox mismatch:\n%q\nwant:\n%q", b, want+want)
+	}
+
+	file, err = ExportMbox(msg, "INBOX", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != path.Join(Config.ArchivePath, "INBOX", "2023.mbox") {
+		t.Errorf("unexpected per-year mbox file %s", file)
+	}
+}
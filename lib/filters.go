@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// compileRegex compiles the rule's regular expression filters
+func (r *Rule) compileRegex() error {
+	var err error
+
+	if r.FromRegex != "" {
+		if r.fromRegex, err = regexp.Compile(r.FromRegex); err != nil {
+			return err
+		}
+	}
+
+	if r.ToRegex != "" {
+		if r.toRegex, err = regexp.Compile(r.ToRegex); err != nil {
+			return err
+		}
+	}
+
+	if r.SubjectRegex != "" {
+		if r.subjectRegex, err = regexp.Compile(r.SubjectRegex); err != nil {
+			return err
+		}
+	}
+
+	if len(r.HeaderRegex) > 0 {
+		r.headerRegex = map[string]*regexp.Regexp{}
+		for k, v := range r.HeaderRegex {
+			if r.headerRegex[k], err = regexp.Compile(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// HasRegex returns whether a rule contains any client-side regular expression filters
+func (r Rule) HasRegex() bool {
+	return r.fromRegex != nil || r.toRegex != nil || r.subjectRegex != nil || len(r.headerRegex) > 0
+}
+
+// MatchRegex returns whether a fetched message matches all the rule's regular expression filters
+func (r Rule) MatchRegex(msg *imap.Message) (bool, error) {
+	if r.fromRegex != nil && !matchAddresses(r.fromRegex, msg.Envelope.From) {
+		return false, nil
+	}
+
+	if r.toRegex != nil && !matchAddresses(r.toRegex, msg.Envelope.To) {
+		return false, nil
+	}
+
+	if r.subjectRegex != nil && !r.subjectRegex.MatchString(msg.Envelope.Subject) {
+		return false, nil
+	}
+
+	if len(r.headerRegex) == 0 {
+		return true, nil
+	}
+
+	b, err := messageBody(msg)
+	if err != nil {
+		return false, err
+	}
+
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return false, err
+	}
+
+	hdr := message.Header{Header: h}
+
+	for k, re := range r.headerRegex {
+		matched := false
+		fields := hdr.FieldsByKey(k)
+		for fields.Next() {
+			v, err := fields.Text()
+			if err != nil {
+				// undecodable, so match against the raw value
+				v = fields.Value()
+			}
+			if re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// matchAddresses returns whether any of the addresses match the regular expression,
+// either as a bare email address or in the "Name <email>" format
+func matchAddresses(re *regexp.Regexp, addresses []*imap.Address) bool {
+	for _, a := range addresses {
+		if re.MatchString(a.Address()) {
+			return true
+		}
+		if a.PersonalName != "" && re.MatchString(fmt.Sprintf("%s <%s>", a.PersonalName, a.Address())) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bodyLiteral is a re-readable imap.Literal holding a fetched message body
+type bodyLiteral struct {
+	*bytes.Reader
+	raw []byte
+}
+
+// messageBody returns the raw fetched body section of a message. The body is
+// replaced with a fresh reader so it can be read again later.
+func messageBody(msg *imap.Message) ([]byte, error) {
+	for section, literal := range msg.Body {
+		if literal == nil {
+			continue
+		}
+
+		var b []byte
+		if l, ok := literal.(*bodyLiteral); ok {
+			b = l.raw
+		} else {
+			var err error
+			if b, err = io.ReadAll(literal); err != nil {
+				return nil, err
+			}
+		}
+
+		msg.Body[section] = &bodyLiteral{bytes.NewReader(b), b}
+
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("Server didn't returned message body")
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// FlagChanges returns the flags & keywords a rule is set to add and remove
+func (r Rule) FlagChanges() (add []string, remove []string) {
+	add, remove = []string{}, []string{}
+
+	for _, a := range r.actions {
+		switch a.Name {
+		case "mark_read":
+			add = append(add, imap.SeenFlag)
+		case "mark_unread":
+			remove = append(remove, imap.SeenFlag)
+		case "flag":
+			add = append(add, imap.FlaggedFlag)
+		case "unflag":
+			remove = append(remove, imap.FlaggedFlag)
+		case "add_keyword":
+			add = append(add, a.Value)
+		case "remove_keyword":
+			remove = append(remove, a.Value)
+		}
+	}
+
+	return add, remove
+}
+
+// validateFlags returns an error if a rule contains invalid or conflicting flag actions
+func (r Rule) validateFlags() error {
+	for _, a := range r.actions {
+		if a.Name != "add_keyword" && a.Name != "remove_keyword" {
+			continue
+		}
+		if strings.HasPrefix(a.Value, "\\") {
+			// system flags such as \Deleted would bypass the dedicated actions & their checks
+			return fmt.Errorf("%s cannot be used for the system flag \"%s\", use mark_read, mark_unread, flag, unflag or delete instead", a.Name, a.Value)
+		}
+		if strings.ContainsAny(a.Value, " (){%*\"\\]") {
+			return fmt.Errorf("\"%s\" is not a valid keyword", a.Value)
+		}
+	}
+
+	add, remove := r.FlagChanges()
+
+	for _, f := range add {
+		if InStringSlice(f, remove) {
+			return fmt.Errorf("Your rule cannot both add and remove \"%s\"", f)
+		}
+	}
+
+	return nil
+}
+
+// ApplyFlags adds and removes flags on a message (by UID), updating the message's flags
+func ApplyFlags(c *client.Client, msg *imap.Message, add, remove []string) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(msg.Uid)
+
+	changes := []struct {
+		op    imap.FlagsOp
+		flags []string
+	}{{imap.AddFlags, add}, {imap.RemoveFlags, remove}}
+
+	for _, change := range changes {
+		if len(change.flags) == 0 {
+			continue
+		}
+
+		values := []interface{}{}
+		for _, f := range change.flags {
+			values = append(values, f)
+		}
+
+		if err := c.UidStore(seqSet, imap.FormatFlagsOp(change.op, true), values, nil); err != nil {
+			return err
+		}
+	}
+
+	flags := []string{}
+	for _, f := range msg.Flags {
+		if !InStringSlice(f, remove) {
+			flags = append(flags, f)
+		}
+	}
+	for _, f := range add {
+		if !InStringSlice(f, flags) {
+			flags = append(flags, f)
+		}
+	}
+	msg.Flags = flags
+
+	return nil
+}
+
+// FormatFlagChanges returns a human-readable list of flag changes, eg: +\Seen -$Todo
+func FormatFlagChanges(add, remove []string) string {
+	changes := []string{}
+	for _, f := range add {
+		changes = append(changes, "+"+f)
+	}
+	for _, f := range remove {
+		changes = append(changes, "-"+f)
+	}
+
+	return strings.Join(changes, " ")
+}
@@ -0,0 +1,31 @@
+package lib
+
+import "testing"
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		actions string
+		err     bool
+	}{
+		{"mark_read, flag", false},
+		{"add_keyword:$Reviewed", false},
+		{"add_keyword:$Todo, remove_keyword:$Done", false},
+		{"add_keyword:\\Deleted", true},
+		{"remove_keyword:\\Seen", true},
+		{"add_keyword:bad keyword", true},
+		{"mark_read, mark_unread", true},
+		{"add_keyword:$Todo, remove_keyword:$Todo", true},
+	}
+
+	for _, tt := range tests {
+		actions, err := parseActions(tt.actions)
+		if err != nil {
+			t.Errorf("parseActions(%q) unexpected error: %s", tt.actions, err)
+			continue
+		}
+		r := Rule{actions: actions}
+		if err := r.validateFlags(); (err != nil) != tt.err {
+			t.Errorf("validateFlags(%q) error = %v, want error %v", tt.actions, err, tt.err)
+		}
+	}
+}
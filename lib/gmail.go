@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// GmailLabelsItem is the fetch item for the Gmail labels of a message
+const GmailLabelsItem imap.FetchItem = "X-GM-LABELS"
+
+// IsGmail returns whether the server supports the Gmail IMAP extensions
+func IsGmail(c *client.Client) bool {
+	ok, _ := c.Support("X-GM-EXT-1")
+	return ok
+}
+
+// GmailLabels returns the Gmail labels of a message, if they were fetched
+func GmailLabels(msg *imap.Message) []string {
+	labels := []string{}
+
+	list, ok := msg.Items[GmailLabelsItem].([]interface{})
+	if !ok {
+		return labels
+	}
+
+	for _, l := range list {
+		if s, err := imap.ParseString(l); err == nil && s != "" {
+			labels = append(labels, s)
+		}
+	}
+
+	return labels
+}
+
+// SetGmailLabels adds Gmail labels to a message (by UID)
+func SetGmailLabels(c *client.Client, uid uint32, labels []string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	values := []interface{}{}
+	for _, l := range labels {
+		if strings.HasPrefix(l, "\\") {
+			// system labels, eg: \Important, are sent as atoms
+			values = append(values, imap.RawString(l))
+		} else {
+			values = append(values, l)
+		}
+	}
+
+	return c.UidStore(seqSet, imap.StoreItem("+X-GM-LABELS.SILENT"), values, nil)
+}
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+var (
+	journalFile *os.File
+)
+
+// JournalEntry is a destructive operation performed on a message. Actions are:
+// append (rewritten copy appended), trash (original moved to trash),
+// expunge (original deleted) and move (original moved to another mailbox).
+type JournalEntry struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Mailbox        string    `json:"mailbox"`
+	UIDValidity    uint32    `json:"uid_validity"`
+	UID            uint32    `json:"uid"`
+	NewMailbox     string    `json:"new_mailbox,omitempty"`
+	NewUIDValidity uint32    `json:"new_uid_validity,omitempty"`
+	NewUID         uint32    `json:"new_uid,omitempty"`
+	MessageID      string    `json:"message_id,omitempty"`
+	Backup         string    `json:"backup,omitempty"`
+}
+
+// WriteJournal appends an entry to the journal file in the backup path
+// (journal-<date>-<time>.jsonl), which is created on the first write of each run.
+// Nothing is written if no backup path is set.
+func WriteJournal(e JournalEntry) error {
+	if Config.BackupPath == "" {
+		return nil
+	}
+
+	if journalFile == nil {
+		if err := CreateDir(Config.BackupPath); err != nil {
+			return err
+		}
+
+		name := AccountFile(path.Join(Config.BackupPath, fmt.Sprintf("journal-%s.jsonl", time.Now().Format("20060102-150405"))))
+
+		// #nosec
+		f, err := os.OpenFile(path.Clean(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		journalFile = f
+		Log.DebugF("Writing journal to %s", name)
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := journalFile.Write(append(j, '\n')); err != nil {
+		return err
+	}
+
+	return journalFile.Sync()
+}
+
+// ReadJournal returns all entries of a journal file
+func ReadJournal(file string) ([]JournalEntry, error) {
+	// #nosec
+	b, err := os.ReadFile(path.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []JournalEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("error parsing %s line %d: %s", file, line, err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Restore undoes the operations of a journal in reverse order, deleting rewritten
+// copies, moving originals back from the trash or another mailbox, and re-appending
+// deleted originals from their backups. If doActions is false, the operations are
+// only listed.
+func Restore(c *client.Client, file string, doActions bool) error {
+	entries, err := ReadJournal(file)
+	if err != nil {
+		return err
+	}
+
+	restored := map[string]bool{}
+	errors := 0
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+
+		switch e.Action {
+		case "append":
+			if e.NewUID == 0 {
+				Log.WarningF("The rewritten copy of %s/%d has no known UID, please delete it manually", e.Mailbox, e.UID)
+				continue
+			}
+
+			Log.InfoF("Delete rewritten copy %s/%d", e.NewMailbox, e.NewUID)
+			if !doActions {
+				continue
+			}
+
+			if err := restoreDelete(c, e); err != nil {
+				Log.Errorf(err.Error())
+				errors++
+				continue
+			}
+			Log.NoticeF(" - Deleted rewritten copy")
+
+		case "trash", "move":
+			if restored[e.Backup] && e.Backup != "" {
+				continue
+			}
+
+			Log.InfoF("Move %s/%d back from \"%s\"", e.Mailbox, e.UID, e.NewMailbox)
+			if !doActions {
+				continue
+			}
+
+			moved, err := restoreMoved(c, e)
+			if err != nil {
+				Log.Errorf(err.Error())
+				errors++
+				continue
+			}
+			if moved {
+				restored[e.Backup] = true
+				Log.NoticeF(" - Moved original message back")
+				continue
+			}
+
+			// the original could not be identified, eg: the trash was emptied
+			if e.Backup == "" {
+				Log.WarningF("Original of %s/%d not found in \"%s\" and no backup, cannot restore", e.Mailbox, e.UID, e.NewMailbox)
+				errors++
+				continue
+			}
+			if err := restoreBackup(c, e); err != nil {
+				Log.Errorf(err.Error())
+				errors++
+				continue
+			}
+			restored[e.Backup] = true
+			Log.NoticeF(" - Restored original message from %s", e.Backup)
+			Log.WarningF(" - Any copy remaining in \"%s\" is now a duplicate", e.NewMailbox)
+
+		case "expunge":
+			if e.Backup == "" {
+				Log.WarningF("No backup of %s/%d, cannot restore", e.Mailbox, e.UID)
+				continue
+			}
+			if restored[e.Backup] {
+				continue
+			}
+
+			Log.InfoF("Restore %s to %s", e.Backup, e.Mailbox)
+			if !doActions {
+				continue
+			}
+
+			if err := restoreBackup(c, e); err != nil {
+				Log.Errorf(err.Error())
+				errors++
+				continue
+			}
+			restored[e.Backup] = true
+			Log.NoticeF(" - Restored original message")
+
+		default:
+			Log.WarningF("Unknown journal action \"%s\"", e.Action)
+		}
+	}
+
+	if errors > 0 {
+		return fmt.Errorf("%d operations could not be restored", errors)
+	}
+
+	return nil
+}
+
+// restoreDelete deletes the rewritten copy of a journal entry, provided the
+// mailbox UID validity is unchanged
+func restoreDelete(c *client.Client, e JournalEntry) error {
+	mbox, err := c.Select(e.NewMailbox, false)
+	if err != nil {
+		return err
+	}
+
+	if e.NewUIDValidity != 0 && mbox.UidValidity != e.NewUIDValidity {
+		return fmt.Errorf("UID validity of \"%s\" has changed, cannot delete %d", e.NewMailbox, e.NewUID)
+	}
+
+	return DeleteMessage(c, e.NewUID)
+}
+
+// restoreMoved moves the original message of a journal entry back from the trash
+// (or the mailbox it was moved to), located by its Message-ID. Returns false if the
+// message is not found exactly once.
+func restoreMoved(c *client.Client, e JournalEntry) (bool, error) {
+	if e.MessageID == "" || e.NewMailbox == "" {
+		return false, nil
+	}
+
+	if _, err := c.Select(e.NewMailbox, false); err != nil {
+		return false, err
+	}
+
+	crit := imap.NewSearchCriteria()
+	crit.Header.Add("Message-Id", e.MessageID)
+	uids, err := c.UidSearch(crit)
+	if err != nil || len(uids) != 1 {
+		return false, err
+	}
+
+	return true, MoveMessage(c, uids[0], e.Mailbox)
+}
+
+// restoreBackup appends the original message of a journal entry from its backup,
+// with the original flags, Gmail labels & internal date
+func restoreBackup(c *client.Client, e JournalEntry) error {
+	raw, info, err := ReadBackup(e.Backup)
+	if err != nil {
+		return err
+	}
+
+	mailbox := info.Mailbox
+	if mailbox == "" {
+		mailbox = e.Mailbox
+	}
+
+	_, uid, err := AppendMessage(c, mailbox, AppendFlags(info.Flags), info.InternalDate, bytes.NewBuffer(raw))
+	if err != nil || uid == 0 || len(info.Labels) == 0 {
+		return err
+	}
+
+	if _, err := c.Select(mailbox, false); err != nil {
+		return err
+	}
+
+	return SetGmailLabels(c, uid, info.Labels)
+}
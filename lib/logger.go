@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"io"
 	"os"
 
 	"github.com/apsdehal/go-logger"
@@ -12,15 +13,20 @@ var (
 )
 
 func init() {
-	Log = initTWLogger()
+	Log = initTWLogger(os.Stdout)
 }
 
-func initTWLogger() *logger.Logger {
+// SetLogOutput redirects the log, eg: to stderr when writing structured output to stdout
+func SetLogOutput(w io.Writer) {
+	Log = initTWLogger(w)
+}
+
+func initTWLogger(w io.Writer) *logger.Logger {
 	var l *logger.Logger
 
 	logLevel := logger.DebugLevel
 
-	l, _ = logger.New("imap-scrub", 1, os.Stdout, logLevel)
+	l, _ = logger.New("imap-scrub", 1, w, logLevel)
 	l.SetFormat("%{message}")
 
 	return l
@@ -1,8 +1,14 @@
 package lib
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/emersion/go-imap"
+	move "github.com/emersion/go-imap-move"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
 )
 
 // ListMailboxes returns a list of Mailboxes on the server
@@ -56,3 +62,112 @@ func DetectTrash(cReader *client.Client) (string, error) {
 
 	return "", nil
 }
+
+// knownMailboxes caches mailboxes which are known to exist on the server
+var knownMailboxes = map[string]bool{}
+
+// MailboxTemplate returns a mailbox name with any date placeholders (%Y, %m, %d)
+// replaced with the date of the message
+func MailboxTemplate(mailbox string, t time.Time) string {
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+	).Replace(mailbox)
+}
+
+// EnsureMailbox creates a mailbox on the server if it does not already exist
+func EnsureMailbox(c *client.Client, mailbox string) error {
+	if knownMailboxes[mailbox] {
+		return nil
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", mailbox, mailboxes)
+	}()
+
+	exists := false
+	for m := range mailboxes {
+		if m.Name == mailbox {
+			exists = true
+		}
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+
+	if !exists {
+		if err := c.Create(mailbox); err != nil {
+			return fmt.Errorf("error creating mailbox \"%s\": %s", mailbox, err)
+		}
+		Log.NoticeF(" - Created mailbox \"%s\"", mailbox)
+	}
+
+	knownMailboxes[mailbox] = true
+
+	return nil
+}
+
+// CopyMessage copies a message (by UID) to another mailbox, creating the mailbox if required
+func CopyMessage(c *client.Client, uid uint32, mailbox string) error {
+	if err := EnsureMailbox(c, mailbox); err != nil {
+		return err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	return c.UidCopy(seqSet, mailbox)
+}
+
+// MoveMessage moves a message (by UID) to another mailbox, creating the mailbox if required.
+// Servers without the MOVE extension fall back to COPY, STORE & EXPUNGE.
+func MoveMessage(c *client.Client, uid uint32, mailbox string) error {
+	if err := EnsureMailbox(c, mailbox); err != nil {
+		return err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	return move.NewClient(c).UidMoveWithFallback(seqSet, mailbox)
+}
+
+// DeleteMessage flags a message (by UID) as deleted & expunges it. If the server
+// supports UIDPLUS only that message is expunged, else the whole mailbox.
+func DeleteMessage(c *client.Client, uid uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+
+	if ok, _ := c.Support("UIDPLUS"); !ok {
+		return c.Expunge(nil)
+	}
+
+	status, err := c.Execute(&commands.Uid{Cmd: &uidExpunge{seqSet}}, nil)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// uidExpunge is the EXPUNGE command with a UID set, sent as UID EXPUNGE (RFC 4315)
+type uidExpunge struct {
+	seqSet *imap.SeqSet
+}
+
+// Command implements imap.Commander
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{cmd.seqSet},
+	}
+}
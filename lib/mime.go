@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// mimePart is a raw MIME entity. Parts are never decoded or re-encoded, so
+// writing an unmodified tree returns the original message byte-for-byte.
+type mimePart struct {
+	Header message.Header
+
+	rawHeader []byte // the raw header, including the blank line separating the body
+	body      []byte // the raw (encoded) body
+
+	// multipart only: separators[i] contains everything preceding children[i]
+	// (the preamble and/or the line break and boundary delimiter line), and the
+	// final separator contains the closing delimiter and epilogue
+	children   []*mimePart
+	separators [][]byte
+
+	// replacement is written instead of the original part, if set
+	replacement []byte
+}
+
+// parseMIME parses a raw message or message part into a tree of MIME parts
+func parseMIME(raw []byte) (*mimePart, error) {
+	p := &mimePart{}
+
+	headerEnd := mimeHeaderEnd(raw)
+	p.rawHeader = raw[:headerEnd]
+	p.body = raw[headerEnd:]
+
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(p.rawHeader)))
+	if err != nil {
+		return nil, err
+	}
+	p.Header = message.Header{Header: h}
+
+	mediaType, params, err := p.Header.ContentType()
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		// treat as a leaf part
+		return p, nil
+	}
+
+	if err := p.parseChildren(params["boundary"]); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// parseChildren splits a multipart body on its boundary delimiter lines
+func (p *mimePart) parseChildren(boundary string) error {
+	delimiter := "--" + boundary
+	closing := delimiter + "--"
+
+	children := []*mimePart{}
+	separators := [][]byte{}
+
+	sepStart := 0    // start of the current separator
+	childStart := -1 // start of the current child, if any
+
+	for pos := 0; pos < len(p.body); {
+		lineEnd := bytes.IndexByte(p.body[pos:], '\n')
+		next := len(p.body)
+		if lineEnd >= 0 {
+			next = pos + lineEnd + 1
+		}
+
+		line := strings.TrimRight(string(p.body[pos:next]), " \t\r\n")
+		if line != delimiter && line != closing {
+			pos = next
+			continue
+		}
+
+		// the line break preceding a delimiter line belongs to the delimiter
+		delimStart := pos
+		if bytes.HasSuffix(p.body[:pos], []byte("\r\n")) {
+			delimStart -= 2
+		} else if bytes.HasSuffix(p.body[:pos], []byte("\n")) {
+			delimStart--
+		}
+		if delimStart < sepStart {
+			delimStart = sepStart
+		}
+		if childStart >= 0 && delimStart < childStart {
+			// empty part
+			delimStart = childStart
+		}
+
+		if childStart >= 0 {
+			child, err := parseMIME(p.body[childStart:delimStart])
+			if err != nil {
+				return err
+			}
+			children = append(children, child)
+			separators = append(separators, p.body[sepStart:childStart])
+			sepStart = delimStart
+		}
+
+		if line == closing {
+			childStart = -1
+			break
+		}
+
+		childStart = next
+		pos = next
+	}
+
+	if childStart >= 0 {
+		// missing closing delimiter, the last part runs to the end of the body
+		child, err := parseMIME(p.body[childStart:])
+		if err != nil {
+			return err
+		}
+		children = append(children, child)
+		separators = append(separators, p.body[sepStart:childStart])
+		sepStart = len(p.body)
+	}
+
+	if len(children) == 0 {
+		return nil
+	}
+
+	p.children = children
+	p.separators = append(separators, p.body[sepStart:])
+
+	return nil
+}
+
+// Bytes returns the raw part, including any replaced children
+func (p *mimePart) Bytes() []byte {
+	if p.replacement != nil {
+		return p.replacement
+	}
+
+	if !p.modified() {
+		return append(append([]byte{}, p.rawHeader...), p.body...)
+	}
+
+	var b bytes.Buffer
+	b.Write(p.rawHeader)
+	for i, child := range p.children {
+		b.Write(p.separators[i])
+		b.Write(child.Bytes())
+	}
+	b.Write(p.separators[len(p.separators)-1])
+
+	return b.Bytes()
+}
+
+// crlf returns whether the part uses CRLF line endings, defaulting to CRLF
+// if the part contains no line breaks
+func (p *mimePart) crlf() bool {
+	for _, b := range [][]byte{p.rawHeader, p.body} {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return i > 0 && b[i-1] == '\r'
+		}
+	}
+
+	return true
+}
+
+// modified returns whether the part or any of its children have been replaced
+func (p *mimePart) modified() bool {
+	if p.replacement != nil {
+		return true
+	}
+	for _, child := range p.children {
+		if child.modified() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Walk calls f for every leaf (non-multipart) part in the tree, in order
+func (p *mimePart) Walk(f func(part *mimePart) error) error {
+	if len(p.children) == 0 {
+		return f(p)
+	}
+
+	for _, child := range p.children {
+		if err := child.Walk(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mimeHeaderEnd returns the position of the body in a raw MIME part
+func mimeHeaderEnd(raw []byte) int {
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		return 2
+	}
+	if bytes.HasPrefix(raw, []byte("\n")) {
+		return 1
+	}
+
+	crlf := bytes.Index(raw, []byte("\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return crlf + 3
+	case lf >= 0:
+		return lf + 2
+	default:
+		// header only
+		return len(raw)
+	}
+}
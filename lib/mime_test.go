@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// nestedMessage is a multipart/mixed message containing a multipart/related
+// part (with a nested multipart/alternative), and an attachment
+var nestedMessage = []string{
+	"From: sender@example.com",
+	"Subject: nested",
+	"MIME-Version: 1.0",
+	`Content-Type: multipart/mixed; boundary="mixed"`,
+	"",
+	"This is a multi-part message in MIME format.",
+	"",
+	"--mixed",
+	`Content-Type: multipart/related; boundary="related"`,
+	"",
+	"--related",
+	`Content-Type: multipart/alternative; boundary="alt"`,
+	"",
+	"--alt",
+	"Content-Type: text/plain; charset=windows-1252",
+	"Content-Transfer-Encoding: quoted-printable",
+	"",
+	"Caf=E9",
+	"--alt",
+	"Content-Type: text/html; charset=windows-1252",
+	"",
+	`<p>Caf` + "\xe9" + `<img src="cid:logo"></p>`,
+	"--alt--",
+	"",
+	"--related",
+	"Content-Type: image/png",
+	"Content-ID: <logo>",
+	"Content-Transfer-Encoding: base64",
+	"",
+	"iVBORw0KGgo=",
+	"--related--",
+	"",
+	"--mixed",
+	`Content-Type: application/pdf; name="report.pdf"`,
+	`Content-Disposition: attachment; filename="report.pdf"`,
+	"Content-Transfer-Encoding: base64",
+	"",
+	"JVBERi0xLjQK",
+	"--mixed--",
+	"epilogue",
+	"",
+}
+
+// leafTypes returns the media types of all leaf parts of a tree
+func leafTypes(t *testing.T, p *mimePart) []string {
+	types := []string{}
+	if err := p.Walk(func(part *mimePart) error {
+		mediaType, _, _ := part.Header.ContentType()
+		types = append(types, mediaType)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return types
+}
+
+func TestParseMIME(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		eol    string
+		leaves []string
+	}{
+		{
+			"nested CRLF",
+			nestedMessage,
+			"\r\n",
+			[]string{"text/plain", "text/html", "image/png", "application/pdf"},
+		},
+		{
+			"nested LF only",
+			nestedMessage,
+			"\n",
+			[]string{"text/plain", "text/html", "image/png", "application/pdf"},
+		},
+		{
+			"single part",
+			[]string{"Subject: plain", "Content-Type: text/plain", "", "hello", ""},
+			"\r\n",
+			[]string{"text/plain"},
+		},
+		{
+			"header only",
+			[]string{"Subject: empty", "Content-Type: text/plain", ""},
+			"\r\n",
+			[]string{"text/plain"},
+		},
+		{
+			"missing closing delimiter",
+			[]string{`Content-Type: multipart/mixed; boundary="b"`, "", "--b", "Content-Type: text/plain", "", "one", "--b", "Content-Type: image/gif", "", "R0lGOD=="},
+			"\r\n",
+			[]string{"text/plain", "image/gif"},
+		},
+		{
+			"empty parts",
+			[]string{`Content-Type: multipart/mixed; boundary="b"`, "", "--b", "--b", "Content-Type: text/plain", "", "one", "--b", "", "--b--", ""},
+			"\r\n",
+			[]string{"text/plain", "text/plain", "text/plain"},
+		},
+		{
+			"transport padding",
+			[]string{`Content-Type: multipart/mixed; boundary="b"`, "", "--b \t", "Content-Type: text/plain", "", "one", "--b  ", "Content-Type: image/gif", "", "R0lGOD==", "--b-- \t", ""},
+			"\r\n",
+			[]string{"text/plain", "image/gif"},
+		},
+		{
+			"boundary prefix in body",
+			[]string{`Content-Type: multipart/mixed; boundary="b"`, "", "--b", "Content-Type: text/plain", "", "--bb is not a delimiter", "--b--", ""},
+			"\n",
+			[]string{"text/plain"},
+		},
+	}
+
+	for _, tt := range tests {
+		raw := []byte(strings.Join(tt.lines, tt.eol))
+
+		root, err := parseMIME(raw)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+
+		if got := root.Bytes(); !bytes.Equal(got, raw) {
+			t.Errorf("%s: round-trip mismatch:\n%q\nwant:\n%q", tt.name, got, raw)
+		}
+
+		if got := leafTypes(t, root); strings.Join(got, ",") != strings.Join(tt.leaves, ",") {
+			t.Errorf("%s: leaf parts = %v, want %v", tt.name, got, tt.leaves)
+		}
+	}
+}
+
+func TestParseMIMEReplace(t *testing.T) {
+	for _, eol := range []string{"\r\n", "\n"} {
+		raw := strings.Join(nestedMessage, eol)
+
+		root, err := parseMIME([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// replace the nested inline image, leaving everything else untouched
+		var image *mimePart
+		if err := root.Walk(func(p *mimePart) error {
+			if mediaType, _, _ := p.Header.ContentType(); mediaType == "image/png" {
+				image = p
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if image == nil {
+			t.Fatal("image part not found")
+		}
+
+		original := string(image.Bytes())
+		image.replacement = []byte("Content-Type: text/plain" + eol + eol + "removed")
+
+		want := strings.Replace(raw, original, string(image.replacement), 1)
+		if got := string(root.Bytes()); got != want {
+			t.Errorf("replaced message mismatch:\n%q\nwant:\n%q", got, want)
+		}
+
+		// re-parsing the rewritten message returns the same structure
+		reparsed, err := parseMIME(root.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := leafTypes(t, reparsed); strings.Join(got, ",") != "text/plain,text/html,text/plain,application/pdf" {
+			t.Errorf("re-parsed leaf parts = %v", got)
+		}
+	}
+}
+
+func TestPlaceholderPartLineEndings(t *testing.T) {
+	for _, eol := range []string{"\r\n", "\n"} {
+		raw := strings.Join([]string{`Content-Type: application/pdf; name="a.pdf"`, "Content-ID: <a>", "", "JVBERi0xLjQK"}, eol)
+
+		p, err := parseMIME([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := placeholderPart(p, "a.pdf", DeletedAttachment{"a.pdf", "application/pdf", "9 B"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lf := bytes.Count(b, []byte("\n"))
+		crlf := bytes.Count(b, []byte("\r\n"))
+		if eol == "\n" && crlf > 0 || eol == "\r\n" && crlf != lf {
+			t.Errorf("placeholder has mixed line endings (original %q): %q", eol, b)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+var (
+	// authentication methods, the default being a LOGIN with the username & password
+	authMethods = []string{"login", "xoauth2", "oauthbearer"}
+
+	// default OAuth2 token endpoints by IMAP host
+	defaultTokenURLs = map[string]string{
+		"imap.gmail.com":        "https://oauth2.googleapis.com/token",
+		"outlook.office365.com": "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+	}
+
+	// access token, shared by all connections
+	accessToken string
+)
+
+// Login authenticates the connection using the configured authentication method.
+// Credentials are never sent without TLS, unless plaintext authentication is allowed.
+func Login(c *client.Client) error {
+	if !c.IsTLS() && !Config.AllowPlaintextAuth {
+		return fmt.Errorf("refusing to log in to %s without TLS, use tls: starttls or set allow_plaintext_auth: true", Config.Host)
+	}
+
+	if Config.Auth == "login" {
+		return c.Login(Config.User, Config.Pass)
+	}
+
+	if accessToken == "" {
+		token, err := AccessToken()
+		if err != nil {
+			return err
+		}
+		accessToken = token
+	}
+
+	if Config.Auth == "oauthbearer" {
+		return c.Authenticate(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: Config.User,
+			Token:    accessToken,
+			Host:     Config.Host,
+			Port:     *Config.Port,
+		}))
+	}
+
+	return c.Authenticate(&xoauth2Client{Config.User, accessToken})
+}
+
+// AccessToken returns an OAuth2 access token, either refreshed from the token endpoint
+// with the refresh token, or read from the token file
+func AccessToken() (string, error) {
+	if Config.RefreshToken == "" {
+		// #nosec
+		b, err := os.ReadFile(path.Clean(Config.TokenFile))
+		if err != nil {
+			return "", fmt.Errorf("token_file: %s", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("token_file: %s is empty", Config.TokenFile)
+		}
+
+		return token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", Config.RefreshToken)
+	form.Set("client_id", Config.ClientID)
+	if Config.ClientSecret != "" {
+		form.Set("client_secret", Config.ClientSecret)
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.PostForm(Config.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing access token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("error refreshing access token: %s", err)
+	}
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("error refreshing access token: %s (HTTP %d)", err, resp.StatusCode)
+	}
+
+	if result.Error != "" {
+		return "", fmt.Errorf("error refreshing access token: %s %s", result.Error, result.ErrorDescription)
+	}
+
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("error refreshing access token: no access token returned (HTTP %d)", resp.StatusCode)
+	}
+
+	return result.AccessToken, nil
+}
+
+// validateAuth validates the authentication options of the global config
+func validateAuth() error {
+	Config.Auth = strings.ToLower(strings.TrimSpace(Config.Auth))
+	if Config.Auth == "" {
+		Config.Auth = "login"
+	}
+
+	if !InStringSlice(Config.Auth, authMethods) {
+		return fmt.Errorf("\"%s\" is not a valid auth method, must be one of: %s", Config.Auth, strings.Join(authMethods, ", "))
+	}
+
+	if Config.Auth == "login" {
+		if !Config.hasPassword() {
+			return fmt.Errorf("Please ensure host, user & password are set")
+		}
+		return nil
+	}
+
+	if Config.RefreshToken == "" && Config.TokenFile == "" {
+		return fmt.Errorf("auth %s requires either a token_file, or a client_id & refresh_token", Config.Auth)
+	}
+
+	if Config.RefreshToken != "" {
+		if Config.ClientID == "" {
+			return fmt.Errorf("refresh_token requires a client_id")
+		}
+		if Config.TokenURL == "" {
+			Config.TokenURL = defaultTokenURLs[strings.ToLower(Config.Host)]
+		}
+		if Config.TokenURL == "" {
+			return fmt.Errorf("refresh_token requires a token_url for %s", Config.Host)
+		}
+	}
+
+	return nil
+}
+
+// xoauth2Client is a SASL XOAUTH2 client, as used by Gmail & Microsoft
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+// Start implements sasl.Client
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next implements sasl.Client. On failure the server sends a (JSON) error challenge,
+// which requires an empty response before the command fails.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAccessToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Method != http.MethodPost || r.Form.Get("grant_type") != "refresh_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.Form.Get("refresh_token") {
+		case "valid":
+			if r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error":"invalid_client"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"token123","token_type":"Bearer","expires_in":3599}`)
+		case "revoked":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+		case "empty":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "<html>Bad Gateway</html>")
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		refreshToken string
+		want         string
+		err          string
+	}{
+		{"valid", "token123", ""},
+		{"revoked", "", "invalid_grant Token has been expired or revoked."},
+		{"empty", "", "no access token returned (HTTP 500)"},
+		{"html", "", "HTTP 502"},
+	}
+
+	for _, tt := range tests {
+		Config = YamlConfig{ClientID: "client", ClientSecret: "secret", RefreshToken: tt.refreshToken, TokenURL: server.URL}
+
+		token, err := AccessToken()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.refreshToken, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.refreshToken, err)
+			continue
+		}
+		if token != tt.want {
+			t.Errorf("%s: token = %q, want %q", tt.refreshToken, token, tt.want)
+		}
+	}
+}
+
+func TestAccessTokenFile(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "token")
+	if err := os.WriteFile(file, []byte("  file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := path.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	Config = YamlConfig{TokenFile: file}
+	if token, err := AccessToken(); err != nil || token != "file-token" {
+		t.Errorf("token file: token = %q, error = %v", token, err)
+	}
+
+	for _, f := range []string{empty, path.Join(dir, "missing")} {
+		Config = YamlConfig{TokenFile: f}
+		if _, err := AccessToken(); err == nil {
+			t.Errorf("token file %s: expected an error", f)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      YamlConfig
+		tokenURL string
+		err      bool
+	}{
+		{"login with password", YamlConfig{Pass: "secret"}, "", false},
+		{"login without password", YamlConfig{}, "", true},
+		{"unknown method", YamlConfig{Auth: "plain", Pass: "secret"}, "", true},
+		{"xoauth2 without token", YamlConfig{Auth: "xoauth2"}, "", true},
+		{"xoauth2 with token file", YamlConfig{Auth: "XOAUTH2", TokenFile: "token"}, "", false},
+		{"refresh token without client id", YamlConfig{Auth: "xoauth2", RefreshToken: "r"}, "", true},
+		{"refresh token with default token url", YamlConfig{Auth: "oauthbearer", Host: "imap.gmail.com", ClientID: "c", RefreshToken: "r"}, "https://oauth2.googleapis.com/token", false},
+		{"refresh token without token url", YamlConfig{Auth: "xoauth2", Host: "imap.example.com", ClientID: "c", RefreshToken: "r"}, "", true},
+		{"refresh token with token url", YamlConfig{Auth: "xoauth2", Host: "imap.example.com", ClientID: "c", RefreshToken: "r", TokenURL: "http://127.0.0.1/token"}, "http://127.0.0.1/token", false},
+	}
+
+	for _, tt := range tests {
+		Config = tt.cfg
+		err := validateAuth()
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && Config.TokenURL != tt.tokenURL {
+			t.Errorf("%s: token_url = %q, want %q", tt.name, Config.TokenURL, tt.tokenURL)
+		}
+	}
+}
+
+func TestXOAuth2ClientStart(t *testing.T) {
+	mech, ir, err := (&xoauth2Client{"user@example.com", "token123"}).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "XOAUTH2" {
+		t.Errorf("mechanism = %s, want XOAUTH2", mech)
+	}
+	if want := "user=user@example.com\x01auth=Bearer token123\x01\x01"; string(ir) != want {
+		t.Errorf("initial response = %q, want %q", ir, want)
+	}
+
+	// an error challenge requires an empty response
+	if resp, err := (&xoauth2Client{}).Next([]byte(`{"status":"400"}`)); err != nil || len(resp) != 0 {
+		t.Errorf("Next() = %q, %v, want an empty response", resp, err)
+	}
+}
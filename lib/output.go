@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// OutputFormats are the supported structured output formats
+var OutputFormats = []string{"json", "csv", "ndjson"}
+
+// Result is the structured output record of a matched message
+type Result struct {
+	Account     string    `json:"account,omitempty"`
+	Rule        int       `json:"rule"`
+	Mailbox     string    `json:"mailbox"`
+	UID         uint32    `json:"uid"`
+	Date        time.Time `json:"date"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Subject     string    `json:"subject"`
+	Size        uint32    `json:"size"`
+	Flags       []string  `json:"flags"`
+	Attachments []string  `json:"attachments"`       // attachments found in the message structure
+	Saved       []string  `json:"saved_attachments"` // files the attachments were saved to
+	Actions     []string  `json:"actions"`
+	Reclaimed   uint64    `json:"reclaimed"` // bytes removed from the server
+	Trashed     uint64    `json:"trashed"`   // bytes reclaimed once the trash is emptied
+	Result      string    `json:"result"`    // matched (no actions), ok or failed
+	Error       string    `json:"error,omitempty"`
+}
+
+// NewResult returns the result record of a matched message
+func NewResult(rule int, mailbox string, msg *imap.Message) Result {
+	r := Result{
+		Account:     Config.Name,
+		Rule:        rule,
+		Mailbox:     mailbox,
+		UID:         msg.Uid,
+		Date:        MessageDate(msg),
+		Size:        msg.Size,
+		Flags:       append([]string{}, msg.Flags...),
+		Attachments: attachmentNames(msg.BodyStructure),
+		Saved:       []string{},
+		Actions:     []string{},
+		Result:      "matched",
+	}
+
+	if msg.Envelope != nil {
+		r.From = formatAddresses(msg.Envelope.From)
+		r.To = formatAddresses(msg.Envelope.To)
+		r.Subject = msg.Envelope.Subject
+	}
+
+	return r
+}
+
+// Output writes results in a structured format to stdout or a file
+type Output struct {
+	format  string
+	w       io.Writer
+	file    *os.File
+	csv     *csv.Writer
+	results []Result
+}
+
+// jsonOutput is the document written in the json format
+type jsonOutput struct {
+	Results []Result `json:"results"`
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// NewOutput returns an Output writing to the file, or stdout if the file is empty
+func NewOutput(format, file string) (*Output, error) {
+	format = strings.ToLower(format)
+	if !InStringSlice(format, OutputFormats) {
+		return nil, fmt.Errorf("\"%s\" is not a valid output format, must be one of: %s", format, strings.Join(OutputFormats, ", "))
+	}
+
+	o := &Output{format: format, w: os.Stdout, results: []Result{}}
+
+	if file != "" {
+		// #nosec
+		f, err := os.Create(path.Clean(file))
+		if err != nil {
+			return nil, err
+		}
+		o.file, o.w = f, f
+	}
+
+	if format == "csv" {
+		o.csv = csv.NewWriter(o.w)
+		if err := o.csv.Write([]string{"account", "rule", "mailbox", "uid", "date", "from", "to", "subject", "size", "flags", "attachments", "saved_attachments", "actions", "reclaimed", "trashed", "result", "error"}); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// Write outputs a result. With the json format, results are written when the output is closed.
+func (o *Output) Write(r Result) error {
+	switch o.format {
+	case "json":
+		o.results = append(o.results, r)
+	case "ndjson":
+		return o.encoder().Encode(r)
+	case "csv":
+		if err := o.csv.Write([]string{
+			r.Account,
+			strconv.Itoa(r.Rule),
+			r.Mailbox,
+			strconv.FormatUint(uint64(r.UID), 10),
+			r.Date.Format(time.RFC3339),
+			r.From,
+			r.To,
+			r.Subject,
+			strconv.FormatUint(uint64(r.Size), 10),
+			strings.Join(r.Flags, " "),
+			strings.Join(r.Attachments, "; "),
+			strings.Join(r.Saved, "; "),
+			strings.Join(r.Actions, "; "),
+			strconv.FormatUint(r.Reclaimed, 10),
+			strconv.FormatUint(r.Trashed, 10),
+			r.Result,
+			r.Error,
+		}); err != nil {
+			return err
+		}
+		o.csv.Flush()
+		return o.csv.Error()
+	}
+
+	return nil
+}
+
+// Close writes any pending output (including the run summary in the json format)
+// & closes the output file
+func (o *Output) Close(summary *Summary) error {
+	if o.format == "json" {
+		enc := o.encoder()
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(jsonOutput{o.results, summary}); err != nil {
+			return err
+		}
+	}
+
+	if o.csv != nil {
+		// the header is still buffered if there were no results
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if o.file != nil {
+		return o.file.Close()
+	}
+
+	return nil
+}
+
+// encoder returns a JSON encoder for the output, without HTML escaping of addresses
+func (o *Output) encoder() *json.Encoder {
+	enc := json.NewEncoder(o.w)
+	enc.SetEscapeHTML(false)
+
+	return enc
+}
+
+// formatAddresses returns a comma-separated list of addresses, eg: Name <user@example.com>
+func formatAddresses(addresses []*imap.Address) string {
+	list := []string{}
+	for _, a := range addresses {
+		if a.PersonalName != "" {
+			list = append(list, fmt.Sprintf("%s <%s>", a.PersonalName, a.Address()))
+		} else {
+			list = append(list, a.Address())
+		}
+	}
+
+	return strings.Join(list, ", ")
+}
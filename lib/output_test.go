@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestOutputCSVHeaderWithoutResults(t *testing.T) {
+	file := path.Join(t.TempDir(), "results.csv")
+
+	o, err := NewOutput("csv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "account,rule,mailbox,uid,") {
+		t.Errorf("missing CSV header: %q", b)
+	}
+}
+
+func TestNewResultAttachments(t *testing.T) {
+	msg := &imap.Message{
+		Uid: 1,
+		BodyStructure: &imap.BodyStructure{
+			MIMEType:    "multipart",
+			MIMESubType: "mixed",
+			Parts: []*imap.BodyStructure{
+				{MIMEType: "text", MIMESubType: "plain"},
+				{MIMEType: "application", MIMESubType: "pdf", Disposition: "attachment", DispositionParams: map[string]string{"filename": "a.pdf"}},
+				{MIMEType: "image", MIMESubType: "png", Disposition: "inline"},
+			},
+		},
+	}
+
+	r := NewResult(1, "INBOX", msg)
+	if got := strings.Join(r.Attachments, ","); got != "a.pdf,image/png" {
+		t.Errorf("NewResult attachments = %s", got)
+	}
+}
@@ -2,14 +2,18 @@ package lib
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"mime"
+	"mime/quotedprintable"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 )
 
 // DeletedAttachment struct
@@ -19,226 +23,183 @@ type DeletedAttachment struct {
 	Size     string
 }
 
-// HandleMessage will process an imap message
-func HandleMessage(msg *imap.Message, rule Rule) (string, int, error) {
-	var section imap.BodySectionName
-
+// HandleMessage will process an imap message, saving and/or replacing any
+// targeted attachments. The original MIME structure of the message is preserved,
+// with only the removed parts being replaced by a short text placeholder.
+// Returns the rewritten message and the targeted attachments.
+func HandleMessage(msg *imap.Message, rule Rule) (string, []DeletedAttachment, error) {
 	imap.CharsetReader = charset.Reader
 
 	if msg == nil {
-		return "", 0, fmt.Errorf("Server didn't returned message")
+		return "", nil, fmt.Errorf("Server didn't returned message")
 	}
 
-	r := msg.GetBody(&section)
-	if r == nil {
-		return "", 0, fmt.Errorf("Server didn't returned message body")
+	raw, err := messageBody(msg)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Create a new mail reader
-	mr, err := mail.CreateReader(r)
+	root, err := parseMIME(raw)
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 
-	var b bytes.Buffer
+	deleted := []DeletedAttachment{}
 
-	mw, err := mail.CreateWriter(&b, mr.Header)
-	if err != nil {
-		return "", 0, err
+	emailAddress := "no-email"
+	if len(msg.Envelope.From) > 0 {
+		emailAddress = msg.Envelope.From[0].Address()
 	}
 
-	defer mw.Close()
+	err = root.Walk(func(p *mimePart) error {
+		mediaType, _, _ := p.Header.ContentType()
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		disposition, _, _ := p.Header.ContentDisposition()
 
-	iw, err := mw.CreateInline()
-	if err != nil {
-		return "", 0, err
-	}
+		if !isAttachment(mediaType, disposition) {
+			return nil
+		}
 
-	deleted := []DeletedAttachment{}
+		filename := partFilename(p)
 
-	froms := msg.Envelope.From
+		if strings.HasSuffix(filename, "-deleted.txt") {
+			// placeholder from a previous run
+			return nil
+		}
 
-	inlineClosed := false
+		b, err := decodePart(p)
+		if err != nil {
+			return err
+		}
 
-	// count the number of message parts. If message has none, return error
-	msgParts := 0
+		if !rule.TargetsAttachment(filename, mediaType, uint64(len(b))) {
+			return nil
+		}
 
-	emailAddress := "no-email"
-	if len(froms) > 0 {
-		emailAddress = froms[0].Address()
-	}
-
-	// Read each mail's part
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			// unhandled characters etc
-			if strings.Contains(err.Error(), "unexpected EOF") {
-				return "", 0, fmt.Errorf("No attachments, skipping")
-			}
-			return "", 0, err
+		if filename == "" {
+			filename = defaultFilename(mediaType)
 		}
 
-		switch h := p.Header.(type) {
-		case *mail.InlineHeader:
-			ct := p.Header.Get("Content-Type")
-
-			msgParts++
-
-			if strings.HasPrefix(ct, "text") {
-				var th mail.InlineHeader
-
-				th.Set("Content-Type", ct)
-
-				if hdr := p.Header.Get("Content-Disposition"); hdr != "" {
-					th.Set("Content-Disposition", hdr)
-				}
-				if hdr := p.Header.Get("Content-Transfer-Encoding"); hdr != "" {
-					th.Set("Content-Transfer-Encoding", hdr)
-				}
-
-				w, err := iw.CreatePart(th)
-				if err != nil {
-					// eg: unhandled charset "windows-1252"
-					if !strings.Contains(err.Error(), "charset") {
-						return "", 0, err
-					}
-
-					// bit of a hack - change charset to utf-8 if unsupported
-					th.Del("Content-Type")
-					if strings.Contains(ct, "text/plain") {
-						th.Set("Content-Type", "text/plain; charset=\"UTF-8\"")
-					} else {
-						th.Set("Content-Type", "text/html; charset=\"UTF-8\"")
-					}
-
-					w, err = iw.CreatePart(th)
-					if err != nil {
-						return "", 0, err
-					}
-				}
-
-				b, err := io.ReadAll(p.Body)
-				if err != nil {
-					return "", 0, err
-				}
-				_, _ = w.Write(b)
-				_ = w.Close()
-			} else if strings.HasPrefix(ct, "image/") {
-				// filename logic taken from https://github.com/emersion/go-message/blob/master/mail/attachment.go
-				_, params, err := h.ContentDisposition()
-				if err != nil {
-					return "", 0, err
-				}
-
-				filename, ok := params["filename"]
-				if !ok {
-					// Using "name" in Content-Type is discouraged
-					_, params, err = h.ContentType()
-					filename = params["name"]
-				}
-
-				b, err := io.ReadAll(p.Body)
-				if err != nil {
-					return "", 0, err
-				}
-				if rule.SaveAttachments() {
-					if filename, err = SaveAttachment(b, emailAddress, filename, msg.Envelope.Date); err != nil {
-						return "", 0, err
-					}
-				}
-
-				ctString := strings.Fields(ct)[0]
-				contentType := ctString[0 : len(ctString)-1]
-				size := ByteCountSI(uint32(len(b)))
-
-				deleted = append(deleted, DeletedAttachment{filename, contentType, size})
+		location := filename
+		if rule.SaveAttachments() {
+			if location, err = SaveAttachment(b, emailAddress, filename, msg.Envelope.Date); err != nil {
+				return err
 			}
+		}
 
-		case *mail.AttachmentHeader:
-			if !inlineClosed {
-				_ = iw.Close() // ensures that no further inline html/text can be written
-				inlineClosed = true
-			}
-			filename, err := h.Filename()
-			if err != nil {
-				return "", 0, err
-			}
+		a := DeletedAttachment{location, mediaType, ByteCountSI(uint64(len(b)))}
 
-			if strings.HasSuffix(filename, "-attachments-deleted.txt") {
-				continue
+		if rule.RemoveAttachments() {
+			if p.replacement, err = placeholderPart(p, filename, a, rule.SaveAttachments()); err != nil {
+				return err
 			}
+		}
 
-			if filename == "" {
-				// plain text messages
-				filename = "text.txt"
-			}
+		deleted = append(deleted, a)
 
-			b, _ := io.ReadAll(p.Body)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
 
-			if rule.SaveAttachments() {
-				if filename, err = SaveAttachment(b, emailAddress, filename, msg.Envelope.Date); err != nil {
-					return "", 0, err
-				}
-			}
+	if len(deleted) > 0 && rule.RemoveAttachments() {
+		Log.NoticeF(" - Removed %d attachments", len(deleted))
+	}
 
-			msgParts++
+	return string(root.Bytes()), deleted, nil
+}
 
-			ct := p.Header.Get("Content-Type")
+// decodePart returns the body of a leaf part with only the transfer encoding
+// decoded. Charsets are never converted, so saved text attachments are identical
+// to the original.
+func decodePart(p *mimePart) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(p.body)
+
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
 
-			size := ByteCountSI(uint32(len(b)))
+	return io.ReadAll(r)
+}
 
-			deleted = append(deleted, DeletedAttachment{filename, ct, size})
-		}
+// partFilename returns the decoded filename of a part, falling back to the raw
+// (undecoded) value if it uses an unsupported charset
+func partFilename(p *mimePart) string {
+	ah := mail.AttachmentHeader{Header: p.Header}
+	if filename, err := ah.Filename(); err == nil {
+		return filename
 	}
 
-	if !inlineClosed {
-		_ = iw.Close() // ensures that no further inline html/text can be written
+	if _, params, _ := p.Header.ContentDisposition(); params["filename"] != "" {
+		return params["filename"]
 	}
+	_, params, _ := p.Header.ContentType()
 
-	if len(deleted) > 0 {
-		if rule.RemoveAttachments() {
-			Log.NoticeF(" - Removed %d attachments", len(deleted))
-		}
-
-		attachmentText := fmt.Sprintf("Attachments were deleted by imap-scrub on the %s", time.Now().Format("2006-01-02 3:4:5pm"))
-		if rule.SaveAttachments() {
-			attachmentText += " and moved to the following locations"
-		}
-		attachmentText += ":\n\n"
+	return params["name"]
+}
 
-		deletedText := ""
-		for _, a := range deleted {
-			deletedText += fmt.Sprintf(" - %s [%s]\n", a.Filename, a.Size)
+// placeholderPart returns a text part to replace a removed attachment. All
+// non-content headers of the original part are kept, so a message consisting
+// of a single attachment retains its message headers. The placeholder uses the
+// same line endings as the original part.
+func placeholderPart(p *mimePart, filename string, a DeletedAttachment, saved bool) ([]byte, error) {
+	h := p.Header.Copy()
+
+	fields := h.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "content-") {
+			fields.Del()
 		}
+	}
 
-		attachmentText += deletedText
+	name := filename + "-deleted.txt"
 
-		var ah mail.AttachmentHeader
+	// fields are prepended, so set in reverse order
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	h.SetContentDisposition("attachment", map[string]string{"filename": name})
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8", "name": name})
 
-		ah.Set("Content-Type", fmt.Sprintf("text/plain; name=\"%d-attachments-deleted.txt\"", len(deleted)))
+	text := fmt.Sprintf("Attachment was deleted by imap-scrub on the %s", time.Now().Format("2006-01-02 3:4:5pm"))
+	if saved {
+		text += " and moved to the following location"
+	}
+	text += fmt.Sprintf(":\n\n - %s [%s]\n", a.Filename, a.Size)
 
-		aw, err := mw.CreateAttachment(ah)
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h.Header); err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return "", 0, err
-		}
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
 
-		if _, err := aw.Write([]byte(attachmentText)); err != nil {
-			return "", 0, err
-		}
-		_ = aw.Close()
-		_ = mw.Close()
+	if !p.crlf() {
+		return bytes.ReplaceAll(b.Bytes(), []byte("\r\n"), []byte("\n")), nil
 	}
 
-	if msgParts == 0 {
-		// github.com/emersion/go-message/mail - This package assumes that a mail message contains
-		// one or more text parts and zero or more attachment parts.
-		// we did not find any message parts (inline text only?)
-		return "", 0, fmt.Errorf("No attachments")
+	return b.Bytes(), nil
+}
+
+// defaultFilename returns a filename for an attachment without one
+func defaultFilename(mediaType string) string {
+	ext := ".bin"
+	if strings.HasPrefix(mediaType, "text/") {
+		ext = ".txt"
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		ext = exts[0]
 	}
 
-	return b.String(), len(deleted), nil
+	return strings.Split(mediaType, "/")[0] + ext
 }
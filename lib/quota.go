@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"gopkg.in/yaml.v3"
+)
+
+// Percent is a percentage, set in yaml as a number or with a percent sign, eg: 80%.
+// 0 is not set.
+type Percent float64
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (p *Percent) UnmarshalYAML(value *yaml.Node) error {
+	v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value.Value), "%")), 64)
+	if err != nil || v < 0 || v >= 100 {
+		return fmt.Errorf("line %d: invalid percentage \"%s\", must be 0 (not set) or less than 100%%", value.Line, value.Value)
+	}
+	*p = Percent(v)
+
+	return nil
+}
+
+// Quota is the storage usage & limit (in bytes) of a quota root (RFC 2087)
+type Quota struct {
+	Root  string
+	Used  uint64
+	Limit uint64
+}
+
+// Percent returns the percentage of the quota used, after removing the reclaimed bytes
+// which are not yet reflected in the usage
+func (q Quota) Percent(reclaimed uint64) float64 {
+	if q.Limit == 0 {
+		return 0
+	}
+
+	used := q.Used
+	if reclaimed > used {
+		used = 0
+	} else {
+		used -= reclaimed
+	}
+
+	return float64(used) / float64(q.Limit) * 100
+}
+
+// String returns the quota usage, eg: 1.2GB of 15.0GB (8.0%)
+func (q Quota) String() string {
+	return fmt.Sprintf("%s of %s (%.1f%%)", ByteCountSI(q.Used), ByteCountSI(q.Limit), q.Percent(0))
+}
+
+// getQuotaRoot is a GETQUOTAROOT command (RFC 2087)
+type getQuotaRoot struct {
+	mailbox string
+}
+
+// Command implements imap.Commander
+func (cmd *getQuotaRoot) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.mailbox)
+
+	return &imap.Command{
+		Name:      "GETQUOTAROOT",
+		Arguments: []interface{}{imap.FormatMailboxName(mailbox)},
+	}
+}
+
+// SupportsQuota returns whether the server supports the QUOTA extension
+func SupportsQuota(c *client.Client) bool {
+	ok, _ := c.Support("QUOTA")
+	return ok
+}
+
+// GetQuota returns the storage quota of a mailbox, or nil if the mailbox has no storage quota
+func GetQuota(c *client.Client, mailbox string) (*Quota, error) {
+	var quota *Quota
+
+	// * QUOTA "" (STORAGE 10 512)
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok || name != "QUOTA" {
+			return responses.ErrUnhandled
+		}
+
+		if len(fields) < 2 || quota != nil {
+			return nil
+		}
+
+		root, _ := imap.ParseString(fields[0])
+		resources, _ := fields[1].([]interface{})
+		for i := 0; i+2 < len(resources); i += 3 {
+			resource, _ := imap.ParseString(resources[i])
+			if !strings.EqualFold(resource, "STORAGE") {
+				continue
+			}
+			used, err1 := imap.ParseNumber(resources[i+1])
+			limit, err2 := imap.ParseNumber(resources[i+2])
+			if err1 == nil && err2 == nil {
+				// storage is in units of 1024 octets
+				quota = &Quota{root, uint64(used) * 1024, uint64(limit) * 1024}
+			}
+		}
+
+		return nil
+	})
+
+	status, err := c.Execute(&getQuotaRoot{mailbox}, handler)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	return quota, nil
+}
+
+// SortUIDs returns the UIDs sorted by received date (oldest first), or by size
+// (largest first)
+func SortUIDs(c *client.Client, uids []uint32, largestFirst bool) ([]uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size}, messages)
+	}()
+
+	list := []*imap.Message{}
+	for msg := range messages {
+		list = append(list, msg)
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if largestFirst {
+			return list[i].Size > list[j].Size
+		}
+		return list[i].InternalDate.Before(list[j].InternalDate)
+	})
+
+	sorted := []uint32{}
+	for _, msg := range list {
+		sorted = append(sorted, msg.Uid)
+	}
+
+	return sorted, nil
+}
+
+// FetchInOrder fetches messages one at a time in the order of the UIDs, until
+// all are fetched or stop is closed. The messages channel is closed when done.
+func FetchInOrder(c *client.Client, uids []uint32, items []imap.FetchItem, messages chan *imap.Message, stop chan struct{}) error {
+	defer close(messages)
+
+	for _, uid := range uids {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+
+		ch := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqSet, items, ch)
+		}()
+
+		stopped := false
+		for msg := range ch {
+			if stopped || msg.Uid != uid {
+				continue
+			}
+			select {
+			case messages <- msg:
+			case <-stop:
+				stopped = true
+			}
+		}
+
+		if err := <-done; err != nil || stopped {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPercentUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Percent
+		err  bool
+	}{
+		{"0", 0, false},
+		{"80", 80, false},
+		{"80%", 80, false},
+		{"\"85.5 %\"", 85.5, false},
+		{"-1", 0, true},
+		{"100%", 0, true},
+		{"eighty", 0, true},
+	}
+
+	for _, tt := range tests {
+		var v struct {
+			P Percent `yaml:"p"`
+		}
+		err := yaml.Unmarshal([]byte("p: "+tt.in), &v)
+		if (err != nil) != tt.err {
+			t.Errorf("Percent(%s) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !tt.err && v.P != tt.want {
+			t.Errorf("Percent(%s) = %v, want %v", tt.in, v.P, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Match is a group of search criteria. All fields within a group must match,
+// and groups can be nested with `all`, `any` and `not`.
+type Match struct {
+	From    StringList `yaml:"from"`
+	To      StringList `yaml:"to"`
+	Subject StringList `yaml:"subject"`
+	Body    string     `yaml:"body"`
+	Text    string     `yaml:"text"`
+	All     []Match    `yaml:"all"`
+	Any     []Match    `yaml:"any"`
+	Not     []Match    `yaml:"not"`
+}
+
+// SearchCriteria returns the IMAP search criteria for a rule, and a
+// human-readable list of the search filters
+func (r Rule) SearchCriteria(now time.Time) (*imap.SearchCriteria, []string) {
+	sFilters := []string{}
+
+	crit := imap.NewSearchCriteria()
+
+	if !r.IncludeUnread {
+		// only seen messages
+		sFilters = append(sFilters, "read")
+		crit.WithFlags = []string{"\\Seen"}
+	}
+
+	if !r.IncludeStarred {
+		// skip starred
+		sFilters = append(sFilters, "unstarred")
+		crit.WithoutFlags = []string{"\\Flagged"}
+	}
+
+	var before, since time.Time
+	dateFilters := []string{}
+
+	if !r.OlderThan.IsZero() {
+		dateFilters = append(dateFilters, fmt.Sprintf("older: %s", r.OlderThan))
+		before = r.OlderThan.Time(now)
+	}
+	if !r.Before.IsZero() {
+		dateFilters = append(dateFilters, fmt.Sprintf("before: %s", r.Before))
+		if t := r.Before.Time(now); before.IsZero() || t.Before(before) {
+			before = t
+		}
+	}
+	if !r.NewerThan.IsZero() {
+		dateFilters = append(dateFilters, fmt.Sprintf("newer: %s", r.NewerThan))
+		since = r.NewerThan.Time(now)
+	}
+	if !r.Since.IsZero() {
+		dateFilters = append(dateFilters, fmt.Sprintf("since: %s", r.Since))
+		if t := r.Since.Time(now); since.IsZero() || t.After(since) {
+			since = t
+		}
+	}
+
+	if r.InternalDate {
+		crit.Before = before
+		crit.Since = since
+		for i, f := range dateFilters {
+			dateFilters[i] = f + " (received)"
+		}
+	} else {
+		crit.SentBefore = before
+		crit.SentSince = since
+	}
+	sFilters = append(sFilters, dateFilters...)
+
+	if r.MinSize > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("larger: %s", r.MinSize))
+		crit.Larger = uint32(r.MinSize)
+	}
+
+	if r.MaxSize > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("smaller: %s", r.MaxSize))
+		crit.Smaller = uint32(r.MaxSize)
+	}
+
+	if r.Match != nil {
+		m, desc := r.Match.criteria()
+		sFilters = append(sFilters, fmt.Sprintf("matching: %s", desc))
+		mergeCriteria(crit, m)
+	}
+
+	if r.Text != "" {
+		sFilters = append(sFilters, fmt.Sprintf("containing: \"%s\"", r.Text))
+		crit.Text = append(crit.Text, r.Text)
+	}
+	if r.Body != "" {
+		sFilters = append(sFilters, fmt.Sprintf("body: \"%s\"", r.Body))
+		crit.Body = append(crit.Body, r.Body)
+	}
+
+	if d := headerCriteria(crit, "From", r.From); d != "" {
+		sFilters = append(sFilters, d)
+	}
+	if d := headerCriteria(crit, "To", r.To); d != "" {
+		sFilters = append(sFilters, d)
+	}
+	if d := headerCriteria(crit, "Subject", r.Subject); d != "" {
+		sFilters = append(sFilters, d)
+	}
+
+	if r.FromRegex != "" {
+		sFilters = append(sFilters, fmt.Sprintf("from matching: /%s/", r.FromRegex))
+	}
+	if r.ToRegex != "" {
+		sFilters = append(sFilters, fmt.Sprintf("to matching: /%s/", r.ToRegex))
+	}
+	if r.SubjectRegex != "" {
+		sFilters = append(sFilters, fmt.Sprintf("subject matching: /%s/", r.SubjectRegex))
+	}
+	for k, v := range r.HeaderRegex {
+		sFilters = append(sFilters, fmt.Sprintf("%s matching: /%s/", k, v))
+	}
+
+	if len(r.AttachmentName) > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("attachment name: %s", strings.Join(r.AttachmentName, " OR ")))
+	}
+	if len(r.AttachmentType) > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("attachment type: %s", strings.Join(r.AttachmentType, " OR ")))
+	}
+	if r.MinAttachmentSize > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("attachment larger: %s", r.MinAttachmentSize))
+	}
+	if r.MinAttachments > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("attachments at least: %d", r.MinAttachments))
+	}
+	if r.MaxAttachments > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("attachments at most: %d", r.MaxAttachments))
+	}
+	if len(r.KeepNames) > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("keeping names: %s", strings.Join(r.KeepNames, ", ")))
+	}
+	if len(r.KeepTypes) > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("keeping types: %s", strings.Join(r.KeepTypes, ", ")))
+	}
+	if r.KeepSmallerThan > 0 {
+		sFilters = append(sFilters, fmt.Sprintf("keeping smaller: %s", r.KeepSmallerThan))
+	}
+
+	return crit, sFilters
+}
+
+// validate returns an error if a match group (or any nested group) is empty
+func (m Match) validate() error {
+	if m.isEmpty() {
+		return fmt.Errorf("empty match group")
+	}
+
+	for _, groups := range [][]Match{m.All, m.Any, m.Not} {
+		for _, g := range groups {
+			if err := g.validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isEmpty returns whether a match group contains no criteria
+func (m Match) isEmpty() bool {
+	return len(m.From) == 0 && len(m.To) == 0 && len(m.Subject) == 0 && m.Body == "" && m.Text == "" &&
+		len(m.All) == 0 && len(m.Any) == 0 && len(m.Not) == 0
+}
+
+// criteria compiles a match group into IMAP search criteria, returning
+// the criteria and a human-readable description
+func (m Match) criteria() (*imap.SearchCriteria, string) {
+	crit := imap.NewSearchCriteria()
+	desc := []string{}
+
+	if d := headerCriteria(crit, "From", m.From); d != "" {
+		desc = append(desc, d)
+	}
+	if d := headerCriteria(crit, "To", m.To); d != "" {
+		desc = append(desc, d)
+	}
+	if d := headerCriteria(crit, "Subject", m.Subject); d != "" {
+		desc = append(desc, d)
+	}
+	if m.Text != "" {
+		desc = append(desc, fmt.Sprintf("containing: \"%s\"", m.Text))
+		crit.Text = append(crit.Text, m.Text)
+	}
+	if m.Body != "" {
+		desc = append(desc, fmt.Sprintf("body: \"%s\"", m.Body))
+		crit.Body = append(crit.Body, m.Body)
+	}
+
+	for _, g := range m.All {
+		c, d := g.criteria()
+		mergeCriteria(crit, c)
+		desc = append(desc, "("+d+")")
+	}
+
+	if len(m.Any) > 0 {
+		c, d := anyCriteria(m.Any)
+		mergeCriteria(crit, c)
+		desc = append(desc, "("+d+")")
+	}
+
+	for _, g := range m.Not {
+		c, d := g.criteria()
+		crit.Not = append(crit.Not, c)
+		desc = append(desc, "NOT ("+d+")")
+	}
+
+	return crit, strings.Join(desc, " AND ")
+}
+
+// headerCriteria adds a header search to the criteria, where any of the values
+// may match, and returns a human-readable description
+func headerCriteria(crit *imap.SearchCriteria, key string, values StringList) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	quoted := []string{}
+	for _, v := range values {
+		quoted = append(quoted, fmt.Sprintf("\"%s\"", v))
+	}
+
+	desc := fmt.Sprintf("%s: %s", strings.ToLower(key), quoted[0])
+	if len(values) > 1 {
+		desc = fmt.Sprintf("%s: (%s)", strings.ToLower(key), strings.Join(quoted, " OR "))
+	}
+
+	mergeCriteria(crit, orHeader(key, values))
+
+	return desc
+}
+
+// orHeader returns search criteria matching a header containing any of the values
+func orHeader(key string, values []string) *imap.SearchCriteria {
+	crit := imap.NewSearchCriteria()
+	if len(values) == 1 {
+		crit.Header.Add(key, values[0])
+		return crit
+	}
+
+	first := imap.NewSearchCriteria()
+	first.Header.Add(key, values[0])
+	crit.Or = [][2]*imap.SearchCriteria{{first, orHeader(key, values[1:])}}
+
+	return crit
+}
+
+// anyCriteria compiles a list of match groups into nested IMAP OR criteria
+func anyCriteria(groups []Match) (*imap.SearchCriteria, string) {
+	first, firstDesc := groups[0].criteria()
+	if strings.Contains(firstDesc, " AND ") {
+		firstDesc = "(" + firstDesc + ")"
+	}
+	if len(groups) == 1 {
+		return first, firstDesc
+	}
+
+	rest, restDesc := anyCriteria(groups[1:])
+
+	crit := imap.NewSearchCriteria()
+	crit.Or = [][2]*imap.SearchCriteria{{first, rest}}
+
+	return crit, firstDesc + " OR " + restDesc
+}
+
+// mergeCriteria adds the search keys of src to dst (AND)
+func mergeCriteria(dst, src *imap.SearchCriteria) {
+	if dst.Header == nil {
+		dst.Header = textproto.MIMEHeader{}
+	}
+	for k, values := range src.Header {
+		for _, v := range values {
+			dst.Header.Add(k, v)
+		}
+	}
+
+	dst.Body = append(dst.Body, src.Body...)
+	dst.Text = append(dst.Text, src.Text...)
+	dst.WithFlags = append(dst.WithFlags, src.WithFlags...)
+	dst.WithoutFlags = append(dst.WithoutFlags, src.WithoutFlags...)
+	dst.Not = append(dst.Not, src.Not...)
+	dst.Or = append(dst.Or, src.Or...)
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gopkg.in/yaml.v3"
+)
+
+// formatSearch returns the IMAP search keys of criteria as a string
+func formatSearch(fields []interface{}) string {
+	s := []string{}
+	for _, f := range fields {
+		switch v := f.(type) {
+		case imap.RawString:
+			s = append(s, string(v))
+		case string:
+			s = append(s, fmt.Sprintf("%q", v))
+		case []interface{}:
+			s = append(s, "("+formatSearch(v)+")")
+		default:
+			s = append(s, fmt.Sprint(v))
+		}
+	}
+
+	return strings.Join(s, " ")
+}
+
+func TestSearchCriteria(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			"read & unstarred by default",
+			`from: a@example.com`,
+			`FROM "a@example.com" SEEN UNFLAGGED`,
+		},
+		{
+			"from list",
+			"from: [invitations@linkedin.com, notification@facebookmail.com, noreply@youtube.com]\ninclude_unread: true\ninclude_starred: true",
+			`OR (FROM "invitations@linkedin.com") (OR (FROM "notification@facebookmail.com") (FROM "noreply@youtube.com"))`,
+		},
+		{
+			"match any & not",
+			"match:\n  any:\n    - from: linkedin.com\n    - from: facebookmail.com\n  not:\n    - subject: invoice\ninclude_unread: true\ninclude_starred: true",
+			`NOT (SUBJECT "invoice") OR (FROM "linkedin.com") (FROM "facebookmail.com")`,
+		},
+		{
+			"match any with multiple fields",
+			"match:\n  any:\n    - from: a.com\n      body: hello\n    - text: world\ninclude_unread: true\ninclude_starred: true",
+			`OR (FROM "a.com" BODY "hello") (TEXT "world")`,
+		},
+		{
+			"match all & nested not",
+			"match:\n  all:\n    - body: one\n    - not:\n        - any:\n            - text: two\n            - text: three\ninclude_unread: true\ninclude_starred: true",
+			`BODY "one" NOT (OR (TEXT "two") (TEXT "three"))`,
+		},
+		{
+			"top-level list merged with match",
+			"subject: [a, b]\nmatch:\n  any:\n    - from: x\n    - from: y\ninclude_unread: true\ninclude_starred: true",
+			`OR (FROM "x") (FROM "y") OR (SUBJECT "a") (SUBJECT "b")`,
+		},
+		{
+			"match any with one group",
+			"match:\n  any:\n    - from: x\nbody: z\ninclude_unread: true\ninclude_starred: true",
+			`FROM "x" BODY "z"`,
+		},
+	}
+
+	for _, tt := range tests {
+		var r Rule
+		if err := yaml.Unmarshal([]byte(tt.rule), &r); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if r.Match != nil {
+			if err := r.Match.validate(); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+		}
+
+		crit, _ := r.SearchCriteria(time.Now())
+		if got := formatSearch(crit.Format()); got != tt.want {
+			t.Errorf("%s:\n got: %s\nwant: %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrHeader(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"a"}, `TO "a"`},
+		{[]string{"a", "b"}, `OR (TO "a") (TO "b")`},
+		{[]string{"a", "b", "c", "d"}, `OR (TO "a") (OR (TO "b") (OR (TO "c") (TO "d")))`},
+	}
+
+	for _, tt := range tests {
+		if got := formatSearch(orHeader("To", tt.values).Format()); got != tt.want {
+			t.Errorf("orHeader(%v) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDescription(t *testing.T) {
+	var m Match
+	if err := yaml.Unmarshal([]byte("any:\n  - from: a\n    subject: b\n  - from: c\nnot:\n  - text: d"), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	_, desc := m.criteria()
+	want := `((from: "a" AND subject: "b") OR from: "c") AND NOT (containing: "d")`
+	if desc != want {
+		t.Errorf("description = %s, want %s", desc, want)
+	}
+}
@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// matches ${VAR}, or an escaped $${VAR}
+var envVarRe = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} with the value of the environment variable in all
+// scalar values of a yaml document. Use $${VAR} for a literal ${VAR}.
+func expandEnv(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if !envVarRe.MatchString(node.Value) {
+			return nil
+		}
+
+		if node.Style == 0 {
+			// the value was parsed as a string, resolve the type again (eg: port: ${PORT})
+			node.Tag = ""
+		}
+
+		var err error
+		node.Value = envVarRe.ReplaceAllStringFunc(node.Value, func(m string) string {
+			if strings.HasPrefix(m, "$$") {
+				return m[1:]
+			}
+			name := envVarRe.FindStringSubmatch(m)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("line %d: environment variable %s is not set", node.Line, name)
+			}
+			return v
+		})
+		return err
+	}
+
+	for _, child := range node.Content {
+		if err := expandEnv(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasPassword returns whether the config sets a password, or a source for it
+func (c YamlConfig) hasPassword() bool {
+	return c.Pass != "" || c.PassEnv != "" || c.PassFile != "" || c.PassCommand != ""
+}
+
+// MaskSecrets replaces the password & OAuth2 secrets of a config, eg: for printing
+func (c *YamlConfig) MaskSecrets() {
+	c.Pass = "**********"
+	for _, secret := range []*string{&c.ClientSecret, &c.RefreshToken} {
+		if *secret != "" {
+			*secret = "**********"
+		}
+	}
+}
+
+// resolvePassword sets the password of the global config from pass, pass_env,
+// pass_file or pass_command (in that order of precedence)
+func resolvePassword() error {
+	switch {
+	case Config.Pass != "":
+		return nil
+
+	case Config.PassEnv != "":
+		Config.Pass = os.Getenv(Config.PassEnv)
+		if Config.Pass == "" {
+			return fmt.Errorf("pass_env: environment variable %s is not set", Config.PassEnv)
+		}
+
+	case Config.PassFile != "":
+		// #nosec
+		b, err := os.ReadFile(path.Clean(Config.PassFile))
+		if err != nil {
+			return fmt.Errorf("pass_file: %s", err)
+		}
+		Config.Pass = strings.TrimSpace(string(b))
+		if Config.Pass == "" {
+			return fmt.Errorf("pass_file: %s is empty", Config.PassFile)
+		}
+
+	case Config.PassCommand != "":
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/C"
+		}
+
+		// #nosec
+		cmd := exec.Command(shell, flag, Config.PassCommand)
+		cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("pass_command: %s", err)
+		}
+		Config.Pass = strings.TrimSpace(string(out))
+		if Config.Pass == "" {
+			return fmt.Errorf("pass_command returned no password")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("IMAP_SCRUB_USER", "user@example.com")
+	t.Setenv("IMAP_SCRUB_EMPTY", "")
+
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"plain", "plain", false},
+		{"${IMAP_SCRUB_USER}", "user@example.com", false},
+		{"prefix-${IMAP_SCRUB_USER}-suffix", "prefix-user@example.com-suffix", false},
+		{"${IMAP_SCRUB_USER}${IMAP_SCRUB_USER}", "user@example.comuser@example.com", false},
+		{"${IMAP_SCRUB_EMPTY}", "", false},
+		{"$${IMAP_SCRUB_USER}", "${IMAP_SCRUB_USER}", false},
+		{"$${IMAP_SCRUB_UNSET}", "${IMAP_SCRUB_UNSET}", false},
+		{"$$${IMAP_SCRUB_USER}", "$${IMAP_SCRUB_USER}", false},
+		{"$IMAP_SCRUB_USER", "$IMAP_SCRUB_USER", false},
+		{"${not valid}", "${not valid}", false},
+		{"${IMAP_SCRUB_UNSET}", "", true},
+	}
+
+	for _, tt := range tests {
+		node := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte("key: '"+tt.in+"'"), node); err != nil {
+			t.Fatal(err)
+		}
+
+		err := expandEnv(node)
+		if (err != nil) != tt.err {
+			t.Errorf("expandEnv(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+
+		var v struct {
+			Key string `yaml:"key"`
+		}
+		if err := node.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Key != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.in, v.Key, tt.want)
+		}
+	}
+}
+
+func TestExpandEnvTypes(t *testing.T) {
+	t.Setenv("IMAP_SCRUB_PORT", "143")
+	t.Setenv("IMAP_SCRUB_BOOL", "true")
+	t.Setenv("IMAP_SCRUB_PASS", "123")
+
+	doc := "host: imap.example.com\n" +
+		"port: ${IMAP_SCRUB_PORT}\n" +
+		"ssl: ${IMAP_SCRUB_BOOL}\n" +
+		"use_trash: ${IMAP_SCRUB_BOOL}\n" +
+		"concurrency: ${IMAP_SCRUB_PORT}\n" +
+		"pass: \"${IMAP_SCRUB_PASS}\"\n" +
+		"user: ${IMAP_SCRUB_PASS}\n" +
+		"rules:\n" +
+		"  - mailbox: INBOX\n" +
+		"    include_unread: ${IMAP_SCRUB_BOOL}\n"
+
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(doc), node); err != nil {
+		t.Fatal(err)
+	}
+	if err := expandEnv(node); err != nil {
+		t.Fatal(err)
+	}
+
+	var c YamlConfig
+	if err := node.Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port == nil || *c.Port != 143 || c.SSL == nil || !*c.SSL || !c.UseTrash || c.Concurrency != 143 {
+		t.Errorf("unexpected config values: %+v", c)
+	}
+	if c.Pass != "123" || c.User != "123" {
+		t.Errorf("pass = %q, user = %q, want 123", c.Pass, c.User)
+	}
+	if len(c.Rules) != 1 || !c.Rules[0].IncludeUnread {
+		t.Errorf("unexpected rules: %+v", c.Rules)
+	}
+
+	// a quoted value remains a string
+	node = &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("port: \"${IMAP_SCRUB_PORT}\""), node); err != nil {
+		t.Fatal(err)
+	}
+	if err := expandEnv(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Decode(&c); err == nil {
+		t.Error("expected an error decoding a quoted port")
+	}
+}
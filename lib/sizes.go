@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var sizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z]*)$`)
+
+// ByteSize is a size in bytes, set in yaml either as a number of kB (512),
+// or as a human-readable size (200k, 5MB, 1.5G)
+type ByteSize uint64
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid size", value.Line)
+	}
+
+	v, err := ParseByteSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+
+	*b = v
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+// String returns a human-readable size
+func (b ByteSize) String() string {
+	return ByteCountSI(uint64(b))
+}
+
+// ParseByteSize parses a human-readable size into bytes. Numbers without
+// a unit are treated as kB.
+func ParseByteSize(s string) (ByteSize, error) {
+	raw := strings.ToLower(strings.TrimSpace(s))
+	if raw == "" {
+		return 0, nil
+	}
+
+	m := sizeRe.FindStringSubmatch(raw)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size \"%s\"", s)
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size \"%s\"", s)
+	}
+
+	var multiplier float64
+	switch m[2] {
+	case "b":
+		multiplier = 1
+	case "", "k", "kb", "kib":
+		multiplier = 1 << 10
+	case "m", "mb", "mib":
+		multiplier = 1 << 20
+	case "g", "gb", "gib":
+		multiplier = 1 << 30
+	default:
+		return 0, fmt.Errorf("invalid size unit \"%s\" in \"%s\"", m[2], s)
+	}
+
+	bytes := n * multiplier
+	if bytes > math.MaxUint32 {
+		// IMAP LARGER & SMALLER search keys are limited to 32-bit numbers
+		return 0, fmt.Errorf("size \"%s\" exceeds the maximum of %s", s, ByteCountSI(math.MaxUint32))
+	}
+
+	return ByteSize(bytes), nil
+}
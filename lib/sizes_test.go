@@ -0,0 +1,48 @@
+package lib
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+		err  bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512 << 10, false}, // numbers without a unit are kB
+		{"100b", 100, false},
+		{"200k", 200 << 10, false},
+		{"200 kB", 200 << 10, false},
+		{"200KiB", 200 << 10, false},
+		{"5MB", 5 << 20, false},
+		{"5m", 5 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"0.5k", 512, false},
+		{"3.5GB", 7 << 29, false},
+		{"4GB", 0, true}, // exceeds the 32-bit IMAP limit
+		{"5000000", 0, true},
+		{"1TB", 0, true},
+		{"-1", 0, true},
+		{"5 M B", 0, true},
+		{"MB", 0, true},
+		{"1,5MB", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q) expected an error, got %d", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) unexpected error: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import "fmt"
+
+// RuleSummary is the summary of the messages matched & actions performed by a rule
+type RuleSummary struct {
+	Rule             int    `json:"rule,omitempty"`
+	Mailbox          string `json:"mailbox,omitempty"`
+	Matched          int    `json:"matched"`
+	Succeeded        int    `json:"succeeded"`
+	Failed           int    `json:"failed"`
+	AttachmentsSaved int    `json:"attachments_saved"`
+	Size             uint64 `json:"size"`      // total size of the matched messages
+	Reclaimed        uint64 `json:"reclaimed"` // bytes removed from the server
+	Trashed          uint64 `json:"trashed"`   // bytes reclaimed once the trash is emptied
+}
+
+// Summary is the summary of a run, per rule and in total
+type Summary struct {
+	Rules []RuleSummary `json:"rules"`
+	Total RuleSummary   `json:"total"`
+}
+
+// NewSummary returns an empty summary for a list of rules
+func NewSummary(rules []Rule) *Summary {
+	s := &Summary{Rules: []RuleSummary{}}
+	for x, rule := range rules {
+		s.Rules = append(s.Rules, RuleSummary{Rule: x + 1, Mailbox: rule.Mailbox})
+	}
+
+	return s
+}
+
+// Add adds a message result to the summary of its rule & the total
+func (s *Summary) Add(r Result) {
+	for _, rs := range []*RuleSummary{&s.Rules[r.Rule-1], &s.Total} {
+		rs.Matched++
+		rs.Size += uint64(r.Size)
+		rs.Reclaimed += r.Reclaimed
+		rs.Trashed += r.Trashed
+
+		switch r.Result {
+		case "ok":
+			rs.Succeeded++
+		case "failed":
+			rs.Failed++
+		}
+
+		rs.AttachmentsSaved += len(r.Saved)
+	}
+}
+
+// Print prints the summary as a table
+func (s *Summary) Print() {
+	Log.InfoF("%-5s %-30s %8s %10s %7s %6s %9s %10s %9s", "Rule", "Mailbox", "Matched", "Succeeded", "Failed", "Saved", "Size", "Reclaimed", "Trashed")
+	for _, rs := range s.Rules {
+		rs.print(fmt.Sprintf("#%d", rs.Rule), Truncate(rs.Mailbox, 30))
+	}
+	s.Total.print("Total", "")
+}
+
+// print prints a summary line
+func (rs RuleSummary) print(rule, mailbox string) {
+	Log.InfoF("%-5s %-30s %8d %10d %7d %6d %9s %10s %9s", rule, mailbox, rs.Matched, rs.Succeeded, rs.Failed,
+		rs.AttachmentsSaved, ByteCountSI(rs.Size), ByteCountSI(rs.Reclaimed), ByteCountSI(rs.Trashed))
+}
@@ -38,7 +38,7 @@ func FileExists(path string) bool {
 func PrintHdrDetails(msg *imap.Message) {
 	e := msg.Envelope
 	from := TruncateFromAddress(e.From)
-	hrSize := ByteCountSI(msg.Size)
+	hrSize := ByteCountSI(uint64(msg.Size))
 	starred := " "
 	if InStringSlice("\\Flagged", msg.Flags) {
 		starred = "*"
@@ -80,7 +80,7 @@ func TruncateFromAddress(from []*imap.Address) string {
 }
 
 // ByteCountSI returns a human-readable size from bytes
-func ByteCountSI(b uint32) string {
+func ByteCountSI(b uint64) string {
 	const unit = 1024
 	if b < unit {
 		return fmt.Sprintf("%dB", b)
@@ -109,50 +109,73 @@ func InStringSlice(val string, slice []string) bool {
 func SaveAttachment(b []byte, emailAddress, fileName string, timestamp time.Time) (string, error) {
 	fileName = path.Clean(filepath.Base(fileName))
 
-	if fileName == "" {
+	if fileName == "" || fileName == "." {
 		return "", fmt.Errorf("Filename empty, not saving")
 	}
 
-	h := sha256.New()
-	h.Write(b)
-	hash := h.Sum(nil)
+	hashed := fmt.Sprintf("%x-%s", contentHash(b), fileName)
 
-	hashed := fmt.Sprintf("%x-%s", hash[0:3], fileName)
-
-	outDir := path.Clean(path.Join(Config.SavePath, emailAddress))
-	if err := CreateDir(outDir); err != nil {
+	outFile, err := savePath(Config.SavePath, emailAddress, hashed)
+	if err != nil {
 		return "", err
 	}
 
-	outFile := path.Clean(path.Join(outDir, hashed))
 	if FileExists(outFile) {
 		Log.WarningF(" - %s already exists", outFile)
 		return outFile, nil
 	}
 
+	if err := writeFile(outFile, b, timestamp, 0664); err != nil {
+		return outFile, err
+	}
+
+	Log.NoticeF(" - Saved %s (%s)", outFile, ByteCountSI(uint64(len(b))))
+
+	return outFile, nil
+}
+
+// savePath returns a sanitized <dir>/<subdir>/<filename> path, creating the directory if required
+func savePath(dir, subDir, fileName string) (string, error) {
+	subDir = fileNameReplacer.Replace(subDir)
+	fileName = fileNameReplacer.Replace(fileName)
+
+	outDir := path.Clean(path.Join(dir, subDir))
+	if err := CreateDir(outDir); err != nil {
+		return "", err
+	}
+
+	return path.Clean(path.Join(outDir, fileName)), nil
+}
+
+// writeFile writes bytes to a file with the given permissions, and sets the file
+// modification time
+func writeFile(outFile string, b []byte, timestamp time.Time, perm os.FileMode) error {
 	// #nosec
 	file, err := os.OpenFile(
 		outFile,
 		os.O_WRONLY|os.O_TRUNC|os.O_CREATE,
-		0664,
+		perm,
 	)
 	if err != nil {
-		return outFile, err
+		return err
 	}
 	defer file.Close()
 
 	// Write bytes to file
-	bytesWritten, err := file.Write(b)
-	if err != nil {
-		return outFile, err
+	if _, err := file.Write(b); err != nil {
+		return err
 	}
-	// write a copy of the attachment
-	bytes := uint32(bytesWritten)
 
 	// set timestamp
 	_ = os.Chtimes(outFile, timestamp, timestamp)
 
-	Log.NoticeF(" - Saved %s (%s)", outFile, ByteCountSI(bytes))
+	return nil
+}
 
-	return outFile, nil
+// contentHash returns a short hash of the content
+func contentHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write(b)
+
+	return h.Sum(nil)[0:3]
 }
@@ -4,7 +4,6 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"net/textproto"
 	"os"
 	"runtime"
 	"strings"
@@ -27,8 +26,8 @@ var (
 )
 
 func main() {
-	var configFile string
-	var listMailboxes, printConfig, showVersion, update bool
+	var configFile, restoreJournal, outputFormat, outputFile, analyzeMailbox, account string
+	var listMailboxes, printConfig, showVersion, update, suggest bool
 	var headersOnly = true
 
 	flag := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
@@ -45,7 +44,13 @@ func main() {
 	// add options
 	flag.BoolVarP(&doActions, "yes", "y", false, "do actions (based on config rule actions)")
 	flag.BoolVarP(&listMailboxes, "mailboxes", "m", false, "list mailboxes on server (helpful for configuration)")
+	flag.StringVarP(&analyzeMailbox, "analyze", "a", "", "analyze a mailbox (helpful for configuration)")
+	flag.BoolVar(&suggest, "suggest", false, "with --analyze, print suggested rules")
 	flag.BoolVarP(&printConfig, "print-config", "p", false, "print config")
+	flag.StringVar(&account, "account", "", "only process the named account (configs with accounts)")
+	flag.StringVarP(&restoreJournal, "restore", "r", "", "undo the operations in a journal file (see backup_path)")
+	flag.StringVarP(&outputFormat, "output", "o", "", "output matched messages as json, csv or ndjson")
+	flag.StringVarP(&outputFile, "output-file", "f", "", "write output to a file instead of stdout")
 	flag.BoolVarP(&update, "update", "u", false, "update to latest release version")
 	flag.BoolVarP(&showVersion, "version", "v", false, "show app version")
 	// avoid 'pflag: help requested' error, as help will be defined later by cobra cmd.Execute()
@@ -89,14 +94,60 @@ func main() {
 
 	configFile = args[0]
 
-	lib.ReadConfig(configFile)
+	if outputFormat != "" && outputFile == "" {
+		// keep stdout for the structured output
+		lib.SetLogOutput(os.Stderr)
+	}
+
+	lib.ReadConfig(configFile, account)
+
+	multiAccount := len(lib.Accounts) > 0 && account == ""
 
 	if printConfig {
-		lib.Config.Pass = "**********"
+		if multiAccount {
+			for x := range lib.Accounts {
+				lib.Accounts[x].MaskSecrets()
+			}
+			lib.PrettyPrint(lib.Accounts)
+			os.Exit(0)
+		}
+		lib.Config.MaskSecrets()
 		lib.PrettyPrint(lib.Config)
 		os.Exit(0)
 	}
 
+	if multiAccount {
+		if restoreJournal != "" {
+			lib.Log.Error("--restore requires --account")
+			os.Exit(2)
+		}
+
+		// every account writes its own json document or csv header, which cannot
+		// be combined on stdout
+		if outputFile == "" && (strings.EqualFold(outputFormat, "json") || strings.EqualFold(outputFormat, "csv")) {
+			lib.Log.ErrorF("--output %s with multiple accounts requires --output-file, or use --output ndjson", outputFormat)
+			os.Exit(2)
+		}
+
+		if failed := lib.RunAccounts(os.Args[1:], lib.Config.Concurrency); failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if outputFile != "" {
+		outputFile = lib.AccountFile(outputFile)
+	}
+
+	var output *lib.Output
+	if outputFormat != "" {
+		var err error
+		if output, err = lib.NewOutput(outputFormat, outputFile); err != nil {
+			lib.Log.Error(err.Error())
+			os.Exit(2)
+		}
+	}
+
 	imapServer := fmt.Sprintf("%s:%d", lib.Config.Host, *lib.Config.Port)
 
 	lib.Log.DebugF("Connecting to %s...", imapServer)
@@ -109,11 +160,11 @@ func main() {
 	defer cWriter.Logout()
 
 	// Login
-	if err := cReader.Login(lib.Config.User, lib.Config.Pass); err != nil {
+	if err := lib.Login(cReader); err != nil {
 		lib.Log.Errorf("%v", err)
 		os.Exit(2)
 	}
-	if err := cWriter.Login(lib.Config.User, lib.Config.Pass); err != nil {
+	if err := lib.Login(cWriter); err != nil {
 		lib.Log.Errorf("%v", err)
 		os.Exit(2)
 	}
@@ -123,19 +174,67 @@ func main() {
 		os.Exit(0)
 	}
 
+	if analyzeMailbox != "" {
+		if err := lib.Analyze(cReader, analyzeMailbox, suggest); err != nil {
+			lib.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if restoreJournal != "" {
+		if err := lib.Restore(cWriter, restoreJournal, doActions); err != nil {
+			lib.Log.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	trashMailbox, err := lib.DetectTrash(cReader)
 	if err != nil {
 		lib.Log.Error(err.Error())
 		os.Exit(2)
 	}
 
-	for _, rule := range lib.Config.Rules {
-		// If we are removing or saving attachments, then pull the whole message in the search
-		if doActions && (rule.RemoveAttachments() || rule.SaveAttachments()) {
-			headersOnly = false
+	gmail := lib.IsGmail(cReader)
+
+	summary := lib.NewSummary(lib.Config.Rules)
+
+	var quota *lib.Quota
+	if lib.SupportsQuota(cReader) {
+		if quota, err = lib.GetQuota(cReader, "INBOX"); err != nil {
+			lib.Log.Errorf(err.Error())
+		} else if quota != nil {
+			lib.Log.InfoF("Quota usage: %s", quota)
+		}
+	}
+
+	quotaTarget := float64(lib.Config.UntilQuotaBelow)
+	if quotaTarget > 0 && quota == nil {
+		lib.Log.Error("until_quota_below requires a server with a storage quota")
+		os.Exit(2)
+	}
+
+	if quotaTarget > 0 && trashMailbox != "" {
+		// trashed messages still count towards the quota, so the target would never be reached
+		lib.Log.Error("until_quota_below cannot be used when messages are moved to the trash (use_trash, or Gmail)")
+		os.Exit(2)
+	}
+
+	// bytes reclaimed since the quota was last fetched
+	var quotaReclaimed uint64
+	quotaReached := quotaTarget > 0 && quota.Percent(0) < quotaTarget
+
+	for x, rule := range lib.Config.Rules {
+		if quotaReached {
+			lib.Log.InfoF("Quota usage is below %.1f%%, stopping", quotaTarget)
+			break
 		}
 
-		sFilters := []string{}
+		// If we are removing or saving attachments, or exporting, then pull the whole message in the search
+		if doActions && rule.NeedsBody() {
+			headersOnly = false
+		}
 
 		// Select mailbox
 		mbox, err := cReader.Select(rule.Mailbox, true)
@@ -151,73 +250,30 @@ func main() {
 		}
 
 		seqSet := new(imap.SeqSet)
-		now := time.Now()
 
 		// search criteria
-		crit := imap.SearchCriteria{}
-
-		if !rule.IncludeUnread {
-			// only seen messages
-			sFilters = append(sFilters, "read")
-			crit.WithFlags = []string{"\\Seen"}
-		}
-
-		if !rule.IncludeStarred {
-			// skip starred
-			sFilters = append(sFilters, "unstarred")
-			crit.WithoutFlags = []string{"\\Flagged"}
-		}
-
-		if rule.OlderThan > 0 {
-			sFilters = append(sFilters, fmt.Sprintf("older: %d days", rule.OlderThan))
-			crit.SentBefore = now.Add(-(time.Duration(rule.OlderThan) * 24 * time.Hour))
-		}
-
-		if rule.Size > 0 {
-			sFilters = append(sFilters, fmt.Sprintf("larger: %s", lib.ByteCountSI(rule.Size)))
-			crit.Larger = rule.Size
-		}
-
-		if rule.Text != "" {
-			sFilters = append(sFilters, fmt.Sprintf("containing: \"%s\"", rule.Text))
-			crit.Text = append(crit.Text, rule.Text)
-		}
-		if rule.Body != "" {
-			sFilters = append(sFilters, fmt.Sprintf("body: \"%s\"", rule.Body))
-			crit.Body = append(crit.Body, rule.Body)
-		}
-
-		headerSearch := textproto.MIMEHeader{}
-
-		if rule.From != "" {
-			sFilters = append(sFilters, fmt.Sprintf("from: \"%s\"", rule.From))
-			headerSearch["From"] = append(headerSearch["From"], rule.From)
-		}
-
-		if rule.To != "" {
-			sFilters = append(sFilters, fmt.Sprintf("to: \"%s\"", rule.To))
-			headerSearch["To"] = append(headerSearch["To"], rule.To)
-		}
-		if rule.Subject != "" {
-			sFilters = append(sFilters, fmt.Sprintf("subject: \"%s\"", rule.Subject))
-			headerSearch["Subject"] = append(headerSearch["Subject"], rule.Subject)
-		}
-
-		if len(headerSearch) > 0 {
-			crit.Header = headerSearch
-		}
+		crit, sFilters := rule.SearchCriteria(time.Now())
 
 		lib.Log.DebugF("Searching \"%s\" for %s", rule.Mailbox, strings.Join(sFilters, ", "))
 
 		// search
-		searchRes, err := cReader.UidSearch(&crit)
+		searchRes, err := cReader.UidSearch(crit)
 		if err != nil {
 			lib.Log.Errorf(err.Error())
 			continue
 		}
 
+		if len(searchRes) > 0 && rule.HasAttachmentFilter() {
+			// only fetch messages with matching attachments
+			searchRes, err = lib.FilterByAttachments(cReader, rule, searchRes)
+			if err != nil {
+				lib.Log.Errorf(err.Error())
+				continue
+			}
+		}
+
 		if len(searchRes) <= 0 {
-			lib.Log.DebugF("%s returned 0 results from the last %d days", rule.Mailbox, rule.OlderThan)
+			lib.Log.DebugF("%s returned 0 results", rule.Mailbox)
 			continue
 		}
 
@@ -241,84 +297,332 @@ func main() {
 		}
 
 		items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, section.FetchItem()}
+		if output != nil {
+			// attachments are listed from the message structure, also in a dry run
+			items = append(items, imap.FetchBodyStructure)
+		}
+		if gmail {
+			items = append(items, lib.GmailLabelsItem)
+		}
 
 		messages := make(chan *imap.Message, 1)
+		stop := make(chan struct{})
 
-		go func() {
-			if err := cReader.UidFetch(seqSet, items, messages); err != nil {
+		if quotaTarget > 0 {
+			// process the oldest or largest messages first, until the quota target is reached
+			uids, err := lib.SortUIDs(cReader, searchRes, lib.Config.QuotaOrder == "largest")
+			if err != nil {
 				lib.Log.Errorf(err.Error())
-				os.Exit(2)
+				continue
 			}
-		}()
+
+			go func() {
+				if err := lib.FetchInOrder(cReader, uids, items, messages, stop); err != nil {
+					lib.Log.Errorf(err.Error())
+					os.Exit(2)
+				}
+			}()
+		} else {
+			go func() {
+				if err := cReader.UidFetch(seqSet, items, messages); err != nil {
+					lib.Log.Errorf(err.Error())
+					os.Exit(2)
+				}
+			}()
+		}
 
 		// total size of all matching emails
-		var totalSize uint32
+		var totalSize uint64
 
 		for msg := range messages {
+			if rule.HasRegex() {
+				matched, err := rule.MatchRegex(msg)
+				if err != nil {
+					lib.Log.Errorf(err.Error())
+					continue
+				}
+				if !matched {
+					continue
+				}
+			}
+
 			// print search result
 			lib.PrintHdrDetails(msg)
 
-			totalSize = totalSize + msg.Size
+			totalSize = totalSize + uint64(msg.Size)
 
-			deletedAttachments := 0
+			result := lib.NewResult(x+1, rule.Mailbox, msg)
 
-			if doActions && (rule.RemoveAttachments() || rule.SaveAttachments()) {
-				raw, attachments, err := lib.HandleMessage(msg, rule)
-				if err != nil {
-					lib.Log.Errorf("%s", err)
-					continue
+			if doActions {
+				if err := messageActions(rule, msg, mbox.UidValidity, trashMailbox, &result); err != nil {
+					lib.Log.Errorf(err.Error())
+					result.Result, result.Error = "failed", err.Error()
+				} else {
+					result.Result = "ok"
 				}
+			}
 
-				if attachments == 0 {
-					lib.Log.Warningf("no attachments detected")
+			summary.Add(result)
+
+			if output != nil {
+				if err := output.Write(result); err != nil {
+					lib.Log.Errorf(err.Error())
+				}
+			}
+
+			if quotaTarget > 0 && result.Reclaimed > 0 {
+				quotaReclaimed += result.Reclaimed
+				if quota.Percent(quotaReclaimed) >= quotaTarget {
 					continue
 				}
 
-				// cReader.SetDebug(os.Stdout)
-				literal := bytes.NewBufferString(raw)
+				// confirm the estimated usage with the server
+				if q, err := lib.GetQuota(cWriter, "INBOX"); err != nil {
+					lib.Log.Errorf(err.Error())
+				} else if q != nil {
+					quota, quotaReclaimed = q, 0
+				}
 
-				if attachments > 0 && rule.RemoveAttachments() {
-					// create a new message and copy envelope & flags
-					if err := cWriter.Append(rule.Mailbox, msg.Flags, msg.Envelope.Date, literal); err != nil {
-						lib.Log.Errorf(err.Error())
-						continue
+				if quota.Percent(quotaReclaimed) < quotaTarget {
+					quotaReached = true
+					close(stop)
+					// wait for the fetch to stop
+					for range messages {
 					}
+					break
 				}
+			}
+		}
+
+		if totalSize > 0 {
+			lib.Log.DebugF("=====\nTotal size: %s\n=====\n", lib.ByteCountSI(totalSize))
+		}
+	}
+
+	summary.Print()
+
+	if quota != nil {
+		if q, err := lib.GetQuota(cWriter, "INBOX"); err != nil {
+			lib.Log.Errorf(err.Error())
+		} else if q != nil {
+			lib.Log.InfoF("Quota usage after run: %s", q)
+		}
+	}
+
+	if output != nil {
+		if err := output.Close(summary); err != nil {
+			lib.Log.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+}
+
+// messageActions performs the rule actions on a message, recording the actions taken
+// in the result. An error is returned if an action fails, in which case no further
+// actions are performed, and the original message is never removed.
+func messageActions(rule lib.Rule, msg *imap.Message, uidValidity uint32, trashMailbox string, result *lib.Result) error {
+	msgDate := lib.MessageDate(msg)
+
+	for _, dest := range rule.CopyTo() {
+		dest = lib.MailboxTemplate(dest, msgDate)
+		if err := lib.CopyMessage(cWriter, msg.Uid, dest); err != nil {
+			// never remove a message which could not be copied
+			return err
+		}
+		lib.Log.NoticeF(" - Copied message to \"%s\"", dest)
+		result.Actions = append(result.Actions, "copy:"+dest)
+	}
+
+	if export, perYear := rule.ExportMbox(); export {
+		file, err := lib.ExportMbox(msg, rule.Mailbox, perYear)
+		if err != nil {
+			// never remove a message which could not be archived
+			return err
+		}
+		lib.Log.NoticeF(" - Exported message to %s", file)
+		result.Actions = append(result.Actions, "export_mbox")
+	}
+
+	if rule.ExportMaildir() {
+		file, err := lib.ExportMaildir(msg, rule.Mailbox)
+		if err != nil {
+			return err
+		}
+		lib.Log.NoticeF(" - Exported message to %s", file)
+		result.Actions = append(result.Actions, "export_maildir")
+	}
+
+	if rule.ExportEml() {
+		file, err := lib.SaveEml(msg)
+		if err != nil {
+			return err
+		}
+		lib.Log.NoticeF(" - Saved message to %s", file)
+		result.Actions = append(result.Actions, "export_eml")
+	}
+
+	// journal of destructive operations on this message
+	journal := lib.JournalEntry{
+		Mailbox:     rule.Mailbox,
+		UIDValidity: uidValidity,
+		UID:         msg.Uid,
+		MessageID:   msg.Envelope.MessageId,
+	}
+
+	if lib.Config.BackupPath != "" && rule.Destructive() {
+		file, err := lib.BackupMessage(msg, rule.Mailbox, uidValidity)
+		if err != nil {
+			// never modify a message which could not be backed up
+			return err
+		}
+		lib.Log.NoticeF(" - Backed up original message to %s", file)
+		journal.Backup = file
+	}
+
+	if add, remove := rule.FlagChanges(); len(add)+len(remove) > 0 {
+		if err := lib.ApplyFlags(cWriter, msg, add, remove); err != nil {
+			return err
+		}
+		changes := lib.FormatFlagChanges(add, remove)
+		lib.Log.NoticeF(" - Updated flags: %s", changes)
+		result.Actions = append(result.Actions, "flags:"+changes)
+	}
+
+	deletedAttachments := 0
+	newSize := uint64(0)
+
+	if rule.RemoveAttachments() || rule.SaveAttachments() {
+		raw, attachments, err := lib.HandleMessage(msg, rule)
+		if err != nil {
+			return err
+		}
 
-				deletedAttachments = attachments
+		if len(attachments) == 0 {
+			// skip the attachment actions only, any other actions still apply
+			lib.Log.Warningf("no attachments detected")
+		}
+
+		if len(attachments) > 0 && rule.SaveAttachments() {
+			for _, a := range attachments {
+				result.Saved = append(result.Saved, a.Filename)
 			}
+			result.Actions = append(result.Actions, "save_attachments")
+		}
 
-			if doActions && (rule.RemoveAttachments() && deletedAttachments > 0 || rule.Delete()) {
-				seqSet := new(imap.SeqSet)
-				seqSet.AddNum(msg.Uid)
+		if len(attachments) > 0 && rule.RemoveAttachments() {
+			literal := bytes.NewBufferString(raw)
 
-				if trashMailbox != "" {
-					// move to Bin
-					mover := move.NewClient(cWriter)
-					if err := mover.UidMove(seqSet, trashMailbox); err != nil {
-						lib.Log.Errorf(err.Error())
-						continue
-					}
-					lib.Log.NoticeF(" - Moved original message to trash")
-				} else {
-					// delete original
-					item := imap.FormatFlagsOp(imap.AddFlags, true)
-					flags := []interface{}{imap.DeletedFlag}
-					if err := cWriter.UidStore(seqSet, item, flags, nil); err != nil {
-						lib.Log.Errorf(err.Error())
-						continue
-					}
-					if err := cWriter.Expunge(nil); err != nil {
-						lib.Log.Errorf(err.Error())
-						continue
-					}
-					lib.Log.NoticeF(" - Deleted original message")
-				}
+			// create a new message with the original internal date, flags & keywords
+			date := msg.InternalDate
+			if date.IsZero() {
+				date = msgDate
+			}
+
+			newUIDValidity, appendUID, err := lib.AppendMessage(cWriter, rule.Mailbox, lib.AppendFlags(msg.Flags), date, literal)
+			if err != nil {
+				return err
+			}
+
+			// never remove the original unless the new message is on the server as expected
+			uid, err := lib.VerifyAppend(cWriter, appendUID, []byte(raw), msg.Envelope.MessageId, msg.Uid)
+			if err != nil {
+				return fmt.Errorf("Failed to verify rewritten message, original kept, %s: %s", discardAppended(appendUID, uid), err)
+			}
+
+			journal.Action, journal.NewMailbox, journal.NewUIDValidity, journal.NewUID = "append", rule.Mailbox, newUIDValidity, uid
+			if err := lib.WriteJournal(journal); err != nil {
+				// never remove the original if the operation cannot be undone
+				return fmt.Errorf("Failed to write journal, original kept, %s: %s", discardAppended(appendUID, uid), err)
 			}
+			journal.NewUIDValidity, journal.NewUID = 0, 0
+
+			if err := lib.SetGmailLabels(cWriter, uid, lib.GmailLabels(msg)); err != nil {
+				return fmt.Errorf("Failed to set labels on rewritten message, original kept, %s: %s", discardAppended(appendUID, uid), err)
+			}
+			result.Actions = append(result.Actions, "remove_attachments")
+			newSize = uint64(len(raw))
 		}
 
-		if totalSize > 0 {
-			lib.Log.DebugF("=====\nTotal size: %s\n=====\n", lib.ByteCountSI(totalSize))
+		deletedAttachments = len(attachments)
+	}
+
+	if rule.RemoveAttachments() && deletedAttachments > 0 || rule.Delete() {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(msg.Uid)
+
+		if trashMailbox != "" {
+			// move to Bin
+			mover := move.NewClient(cWriter)
+			if err := mover.UidMove(seqSet, trashMailbox); err != nil {
+				return err
+			}
+			lib.Log.NoticeF(" - Moved original message to trash")
+			result.Actions = append(result.Actions, "trash")
+			// trashed messages still count towards the server storage until the trash is emptied
+			result.Trashed = reclaimed(msg.Size, newSize)
+
+			journal.Action, journal.NewMailbox = "trash", trashMailbox
+			if err := lib.WriteJournal(journal); err != nil {
+				return fmt.Errorf("Moved to trash, but failed to write journal: %s", err)
+			}
+		} else {
+			// delete original
+			if err := lib.DeleteMessage(cWriter, msg.Uid); err != nil {
+				return err
+			}
+			lib.Log.NoticeF(" - Deleted original message")
+			result.Actions = append(result.Actions, "delete")
+			result.Reclaimed = reclaimed(msg.Size, newSize)
+
+			journal.Action, journal.NewMailbox = "expunge", ""
+			if err := lib.WriteJournal(journal); err != nil {
+				return fmt.Errorf("Deleted, but failed to write journal: %s", err)
+			}
+		}
+	}
+
+	if rule.MoveTo() != "" {
+		dest := lib.MailboxTemplate(rule.MoveTo(), msgDate)
+		if err := lib.MoveMessage(cWriter, msg.Uid, dest); err != nil {
+			return err
+		}
+		lib.Log.NoticeF(" - Moved message to \"%s\"", dest)
+		result.Actions = append(result.Actions, "move:"+dest)
+
+		journal.Action, journal.NewMailbox = "move", dest
+		if err := lib.WriteJournal(journal); err != nil {
+			return fmt.Errorf("Moved, but failed to write journal: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// discardAppended deletes a rewritten message which is not used, so no duplicate of the
+// original is left behind. Only a UID returned by the server when appending (APPENDUID)
+// is deleted, as a message found by its Message-ID may be another copy of the original.
+// Returns a description of the outcome.
+func discardAppended(appendUID, foundUID uint32) string {
+	if appendUID == 0 {
+		if foundUID != 0 {
+			return fmt.Sprintf("the rewritten copy is probably UID %d, which was left untouched as it cannot be confirmed without UIDPLUS", foundUID)
 		}
+		return "the rewritten copy could not be located and may remain in the mailbox"
+	}
+
+	if err := lib.DeleteMessage(cWriter, appendUID); err != nil {
+		return fmt.Sprintf("the rewritten copy (UID %d) could not be deleted (%s)", appendUID, err)
 	}
+
+	return "rewritten copy deleted"
+}
+
+// reclaimed returns the bytes removed from the server by replacing a message with a
+// rewritten message of newSize bytes (0 if deleted)
+func reclaimed(size uint32, newSize uint64) uint64 {
+	if newSize >= uint64(size) {
+		return 0
+	}
+
+	return uint64(size) - newSize
 }